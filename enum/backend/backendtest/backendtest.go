@@ -0,0 +1,559 @@
+// Copyright 2016 Hadrien Kohl hadrien.kohl@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package backendtest checks that a Backend implementation behaves like the
+// documentation of the enum.Backend interface says it should.
+//
+// Implementations run the suite from one of their tests:
+//
+//	func TestConformance(t *testing.T) {
+//		backendtest.TestBackend(t, func() (enum.Backend, error) {
+//			return NewMyBackend()
+//		})
+//	}
+package backendtest
+
+import (
+	"enum-dns/enum"
+	"fmt"
+	"math"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Factory returns a new empty backend. Every test case uses its own backend
+// and closes it once done.
+type Factory func() (enum.Backend, error)
+
+// Keys of all the numbers. The upper bound fits in a signed integer for the
+// backends storing them that way.
+const (
+	min uint64 = 0
+	max uint64 = math.MaxInt64
+)
+
+var sip = []enum.Record{
+	{Order: 10, Preference: 100, Flags: "u", Service: "E2U+sip",
+		Regexp: "!^(.*)$!sip:\\1@example.com!", Replacement: "."},
+}
+
+var sipAndMail = []enum.Record{
+	{Order: 10, Preference: 100, Flags: "u", Service: "E2U+sip",
+		Regexp: "!^(.*)$!sip:\\1@example.net!", Replacement: "."},
+	{Order: 20, Preference: 100, Flags: "u", Service: "E2U+email:mailto",
+		Regexp: "!^(.*)$!mailto:\\1@example.net!", Replacement: "."},
+}
+
+func r(l, u uint64, records []enum.Record) enum.NumberRange {
+	return enum.NumberRange{Lower: l, Upper: u, Records: records}
+}
+
+// The key of a number.
+func key(number string) uint64 {
+	k, err := enum.NumberToKey(number)
+	if err != nil {
+		panic(err)
+	}
+	return k
+}
+
+func ttl(ttl uint32) *uint32 {
+	return &ttl
+}
+
+// Three adjacent ranges used as the initial content of most cases. The
+// second one has a TTL.
+var three = []enum.NumberRange{
+	r(200000000000000, 299999999999999, sip),
+	{Lower: 300000000000000, Upper: 399999999999999, Records: sipAndMail, Ttl: ttl(300)},
+	r(400000000000000, 499999999999999, nil),
+}
+
+// Records of other types than NAPTR.
+var typed = []enum.Record{
+	{Type: enum.URIRecord, Priority: 10, Weight: 1, Target: "sip:+33123456789@example.net"},
+	{Type: enum.TXTRecord, Text: "Example Telecom"},
+}
+
+// A range delegated to other name servers.
+var delegated = enum.NumberRange{
+	Lower: 600000000000000, Upper: 699999999999999,
+	NameServers: []enum.NameServer{
+		{Name: "ns1.6.e164.arpa.", Addresses: []string{"192.0.2.1", "2001:db8::1"}},
+		{Name: "ns2.example.net."},
+	},
+}
+
+// What is left of the delegated range after a change.
+func delegatedPiece(l, u uint64) enum.NumberRange {
+	p := delegated
+	p.Lower, p.Upper = l, u
+	return p
+}
+
+// What is left of the second range of three after a change.
+func piece(l, u uint64) enum.NumberRange {
+	p := three[1]
+	p.Lower, p.Upper = l, u
+	return p
+}
+
+var pushCases = []struct {
+	name     string
+	initial  []enum.NumberRange
+	push     enum.NumberRange
+	returned []enum.NumberRange
+	result   []enum.NumberRange
+}{
+	{"empty", nil,
+		r(300000000000000, 399999999999999, sip),
+		nil,
+		[]enum.NumberRange{r(300000000000000, 399999999999999, sip)},
+	},
+	{"outside", three,
+		r(600000000000000, 699999999999999, sip),
+		nil,
+		append(three[:3:3], r(600000000000000, 699999999999999, sip)),
+	},
+	{"replace", three,
+		r(300000000000000, 399999999999999, sip),
+		[]enum.NumberRange{three[1]},
+		[]enum.NumberRange{three[0], r(300000000000000, 399999999999999, sip), three[2]},
+	},
+	{"split", three,
+		r(350000000000000, 350000000000000, sip),
+		[]enum.NumberRange{three[1]},
+		[]enum.NumberRange{
+			three[0],
+			piece(300000000000000, 349999999999999),
+			r(350000000000000, 350000000000000, sip),
+			piece(350000000000001, 399999999999999),
+			three[2],
+		},
+	},
+	{"starts", three,
+		r(300000000000000, 349999999999999, sip),
+		[]enum.NumberRange{three[1]},
+		[]enum.NumberRange{
+			three[0],
+			r(300000000000000, 349999999999999, sip),
+			piece(350000000000000, 399999999999999),
+			three[2],
+		},
+	},
+	{"finishes", three,
+		r(350000000000000, 399999999999999, sip),
+		[]enum.NumberRange{three[1]},
+		[]enum.NumberRange{
+			three[0],
+			piece(300000000000000, 349999999999999),
+			r(350000000000000, 399999999999999, sip),
+			three[2],
+		},
+	},
+	{"trim both", three,
+		r(250000000000000, 449999999999999, nil),
+		three,
+		[]enum.NumberRange{
+			r(200000000000000, 249999999999999, sip),
+			r(250000000000000, 449999999999999, nil),
+			r(450000000000000, 499999999999999, nil),
+		},
+	},
+	{"delete all", three,
+		r(100000000000000, 599999999999999, sipAndMail),
+		three,
+		[]enum.NumberRange{r(100000000000000, 599999999999999, sipAndMail)},
+	},
+	// Numbers of other lengths never overlap with the ones of three.
+	{"other lengths", three,
+		r(key("3000"), key("3999"), sip),
+		nil,
+		append(three[:3:3], r(key("3000"), key("3999"), sip)),
+	},
+	{"leading zeros", three,
+		r(key("0300000000000000"), key("0399999999999999"), sip),
+		nil,
+		append(three[:3:3], r(key("0300000000000000"), key("0399999999999999"), sip)),
+	},
+	{"typed records", three,
+		r(600000000000000, 699999999999999, typed),
+		nil,
+		append(three[:3:3], r(600000000000000, 699999999999999, typed)),
+	},
+	{"delegation", three,
+		delegated,
+		nil,
+		append(three[:3:3], delegated),
+	},
+	{"split delegation", []enum.NumberRange{delegated},
+		r(650000000000000, 650000000000000, sip),
+		[]enum.NumberRange{delegated},
+		[]enum.NumberRange{
+			delegatedPiece(600000000000000, 649999999999999),
+			r(650000000000000, 650000000000000, sip),
+			delegatedPiece(650000000000001, 699999999999999),
+		},
+	},
+}
+
+var deleteCases = []struct {
+	name     string
+	initial  []enum.NumberRange
+	l, u     uint64
+	returned []enum.NumberRange
+	result   []enum.NumberRange
+}{
+	{"empty", nil, 300000000000000, 399999999999999, nil, nil},
+	{"outside", three, 600000000000000, 699999999999999, nil, three},
+	{"exact", three, 300000000000000, 399999999999999,
+		[]enum.NumberRange{three[1]},
+		[]enum.NumberRange{three[0], three[2]},
+	},
+	{"hole", three, 350000000000000, 350000000000000,
+		[]enum.NumberRange{three[1]},
+		[]enum.NumberRange{
+			three[0],
+			piece(300000000000000, 349999999999999),
+			piece(350000000000001, 399999999999999),
+			three[2],
+		},
+	},
+	{"trim both", three, 250000000000000, 449999999999999,
+		three,
+		[]enum.NumberRange{
+			r(200000000000000, 249999999999999, sip),
+			r(450000000000000, 499999999999999, nil),
+		},
+	},
+	{"all", three, 100000000000000, 599999999999999, three, nil},
+}
+
+var batchCases = []struct {
+	name     string
+	ops      []enum.Operation
+	fails    bool
+	returned []enum.NumberRange
+	result   []enum.NumberRange
+}{
+	{"empty", nil, false, nil, three},
+	{"push and delete", []enum.Operation{
+		{Op: enum.PushOperation, Range: r(350000000000000, 350000000000000, sip)},
+		{Op: enum.DeleteOperation, Range: r(200000000000000, 249999999999999, nil)},
+	}, false,
+		[]enum.NumberRange{three[1], three[0]},
+		[]enum.NumberRange{
+			r(250000000000000, 299999999999999, sip),
+			piece(300000000000000, 349999999999999),
+			r(350000000000000, 350000000000000, sip),
+			piece(350000000000001, 399999999999999),
+			three[2],
+		},
+	},
+	{"sees previous operations", []enum.Operation{
+		{Op: enum.PushOperation, Range: r(600000000000000, 699999999999999, sip)},
+		{Op: enum.DeleteOperation, Range: r(600000000000000, 699999999999999, nil)},
+	}, false,
+		[]enum.NumberRange{r(600000000000000, 699999999999999, sip)},
+		three,
+	},
+	{"unknown operation", []enum.Operation{
+		{Op: enum.PushOperation, Range: r(350000000000000, 350000000000000, sip)},
+		{Op: "unknown", Range: r(200000000000000, 249999999999999, nil)},
+	}, true, nil, three},
+	{"bounds of different lengths", []enum.Operation{
+		{Op: enum.DeleteOperation, Range: r(200000000000000, 499999999999999, nil)},
+		{Op: enum.PushOperation, Range: r(350000000000000, key("3500000000000000"), sip)},
+	}, true, nil, three},
+	{"reversed bounds", []enum.Operation{
+		{Op: enum.DeleteOperation, Range: r(200000000000000, 499999999999999, nil)},
+		{Op: enum.PushOperation, Range: r(399999999999999, 300000000000000, sip)},
+	}, true, nil, three},
+	{"not a number", []enum.Operation{
+		{Op: enum.DeleteOperation, Range: r(200000000000000, 499999999999999, nil)},
+		{Op: enum.PushOperation, Range: r(math.MaxUint64-1, math.MaxUint64, sip)},
+	}, true, nil, three},
+	{"delegation with records", []enum.Operation{
+		{Op: enum.DeleteOperation, Range: r(200000000000000, 499999999999999, nil)},
+		{Op: enum.PushOperation, Range: enum.NumberRange{
+			Lower: 600000000000000, Upper: 699999999999999, Records: sip, NameServers: delegated.NameServers,
+		}},
+	}, true, nil, three},
+}
+
+var betweenCases = []struct {
+	name   string
+	l, u   uint64
+	c      int
+	result []enum.NumberRange
+}{
+	{"number", 350000000000000, 350000000000000, 1, three[1:2]},
+	{"lower bound", 300000000000000, 300000000000000, 1, three[1:2]},
+	{"upper bound", 399999999999999, 399999999999999, 1, three[1:2]},
+	{"no match", 600000000000000, 600000000000000, 1, nil},
+	{"all", min, max, 10, three},
+	{"count", min, max, 2, three[:2]},
+	{"reverse", min, max, -10, []enum.NumberRange{three[2], three[1], three[0]}},
+	{"reverse count", min, max, -2, []enum.NumberRange{three[2], three[1]}},
+	{"zero count", min, max, 0, nil},
+	{"overlapping", 250000000000000, 350000000000000, 10, three[:2]},
+	{"overlapping reverse", 250000000000000, 350000000000000, -1, three[1:2]},
+}
+
+var getCases = []struct {
+	name   string
+	l, u   uint64
+	result *enum.NumberRange
+}{
+	{"exact", 300000000000000, 399999999999999, &three[1]},
+	{"lower only", 300000000000000, 349999999999999, nil},
+	{"upper only", 350000000000000, 399999999999999, nil},
+	{"enclosing", 200000000000000, 499999999999999, nil},
+	{"outside", 600000000000000, 699999999999999, nil},
+}
+
+// TestBackend runs the conformance suite against the backends created by f.
+func TestBackend(t *testing.T, f Factory) {
+	for _, c := range pushCases {
+		t.Run("PushRange/"+c.name, func(t *testing.T) {
+			b := load(t, f, c.initial)
+			defer b.Close()
+
+			events, stop := watch(b)
+			defer stop()
+
+			returned, err := b.PushRange(c.push)
+			if err != nil {
+				t.Fatalf("PushRange(%v) failed: %v", format(c.push), err)
+			}
+			checkRanges(t, fmt.Sprintf("PushRange(%v)", format(c.push)), returned, c.returned)
+			checkContent(t, b, c.result)
+			checkEvents(t, events, enum.Events(c.push, c.returned, c.push))
+		})
+	}
+
+	for _, c := range deleteCases {
+		t.Run("DeleteRange/"+c.name, func(t *testing.T) {
+			b := load(t, f, c.initial)
+			defer b.Close()
+
+			events, stop := watch(b)
+			defer stop()
+
+			returned, err := b.DeleteRange(c.l, c.u)
+			if err != nil {
+				t.Fatalf("DeleteRange(%d, %d) failed: %v", c.l, c.u, err)
+			}
+			checkRanges(t, fmt.Sprintf("DeleteRange(%d, %d)", c.l, c.u), returned, c.returned)
+			checkContent(t, b, c.result)
+			checkEvents(t, events, enum.Events(r(c.l, c.u, nil), c.returned))
+		})
+	}
+
+	for _, c := range batchCases {
+		t.Run("Batch/"+c.name, func(t *testing.T) {
+			b := load(t, f, three)
+			defer b.Close()
+
+			// A batch is one change, and a failed one is none.
+			changes := 0
+			stop := enum.Observe(b, new(sync.Mutex), func(events []enum.Event) { changes++ })
+			defer stop()
+
+			returned, err := b.Batch(c.ops)
+			if _, ok := b.(enum.Observer); ok && (changes > 1 || (c.fails && changes > 0)) {
+				t.Errorf("Batch(%v) made %d changes", c.ops, changes)
+			}
+			if c.fails {
+				if err == nil {
+					t.Errorf("Batch(%v) succeeded, expected an error", c.ops)
+				}
+			} else {
+				if err != nil {
+					t.Fatalf("Batch(%v) failed: %v", c.ops, err)
+				}
+				checkRanges(t, fmt.Sprintf("Batch(%v)", c.ops), returned, c.returned)
+			}
+			checkContent(t, b, c.result)
+		})
+	}
+
+	for _, c := range betweenCases {
+		t.Run("RangesBetween/"+c.name, func(t *testing.T) {
+			b := load(t, f, three)
+			defer b.Close()
+
+			results, err := b.RangesBetween(c.l, c.u, c.c)
+			if err != nil {
+				t.Fatalf("RangesBetween(%d, %d, %d) failed: %v", c.l, c.u, c.c, err)
+			}
+			checkRanges(t, fmt.Sprintf("RangesBetween(%d, %d, %d)", c.l, c.u, c.c), results, c.result)
+		})
+	}
+
+	for _, c := range getCases {
+		t.Run("GetRange/"+c.name, func(t *testing.T) {
+			b := load(t, f, three)
+			defer b.Close()
+
+			result, err := b.GetRange(c.l, c.u)
+			if err != nil {
+				t.Fatalf("GetRange(%d, %d) failed: %v", c.l, c.u, err)
+			}
+			switch {
+			case c.result == nil && result != nil:
+				t.Errorf("GetRange(%d, %d) returned %v, expected nil", c.l, c.u, format(*result))
+			case c.result != nil && result == nil:
+				t.Errorf("GetRange(%d, %d) returned nil, expected %v", c.l, c.u, format(*c.result))
+			case c.result != nil && !Equal(*result, *c.result):
+				t.Errorf("GetRange(%d, %d) returned %v, expected %v", c.l, c.u, format(*result), format(*c.result))
+			}
+		})
+	}
+}
+
+// Watch the backend if it implements enum.Watcher. The returned channel is nil
+// otherwise.
+func watch(b enum.Backend) (<-chan enum.Event, func()) {
+	if w, ok := b.(enum.Watcher); ok {
+		return w.Watch()
+	}
+	return nil, func() {}
+}
+
+// Check that the expected events, and only them, were received. They are the
+// events of one change and have its number.
+func checkEvents(t *testing.T, events <-chan enum.Event, expected []enum.Event) {
+	if events == nil {
+		return
+	}
+	var change uint64
+	for i, e := range expected {
+		select {
+		case received, ok := <-events:
+			if !ok {
+				t.Fatalf("events channel closed after %d events, expected %d", i, len(expected))
+			}
+			if !sameEvent(received, e) {
+				t.Errorf("received event %v at %d, expected %v", formatEvent(received), i, formatEvent(e))
+			}
+			if i == 0 {
+				change = received.Change
+			}
+			if received.Change == 0 || received.Change != change {
+				t.Errorf("received event %v of change %d, expected %d", formatEvent(received), received.Change, change)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("received %d events, expected %d", i, len(expected))
+		}
+	}
+	select {
+	case e := <-events:
+		t.Errorf("received unexpected event %v", formatEvent(e))
+	default:
+	}
+}
+
+func sameEvent(a, b enum.Event) bool {
+	same := func(a, b *enum.NumberRange) bool {
+		return (a == nil && b == nil) || (a != nil && b != nil && Equal(*a, *b))
+	}
+	return a.Type == b.Type && same(a.Before, b.Before) && same(a.After, b.After)
+}
+
+func formatEvent(e enum.Event) string {
+	s := e.Type
+	if e.Before != nil {
+		s += " before " + format(*e.Before)
+	}
+	if e.After != nil {
+		s += " after " + format(*e.After)
+	}
+	return s
+}
+
+// Create a backend and push the ranges into it.
+func load(t *testing.T, f Factory, ranges []enum.NumberRange) enum.Backend {
+	b, err := f()
+	if err != nil {
+		t.Fatalf("could not create the backend: %v", err)
+	}
+	for _, r := range ranges {
+		if _, err := b.PushRange(r); err != nil {
+			b.Close()
+			t.Fatalf("PushRange(%v) failed: %v", format(r), err)
+		}
+	}
+	return b
+}
+
+// Check that the backend holds exactly the expected ranges.
+func checkContent(t *testing.T, b enum.Backend, expected []enum.NumberRange) {
+	results, err := b.RangesBetween(min, max, len(expected)+1)
+	if err != nil {
+		t.Fatalf("RangesBetween(%d, %d, %d) failed: %v", min, max, len(expected)+1, err)
+	}
+	checkRanges(t, "content", results, expected)
+}
+
+func checkRanges(t *testing.T, what string, results, expected []enum.NumberRange) {
+	if len(results) != len(expected) {
+		t.Errorf("%s returned %d ranges, expected %d", what, len(results), len(expected))
+	}
+	for i := 0; i < len(results) && i < len(expected); i++ {
+		if !Equal(results[i], expected[i]) {
+			t.Errorf("%s returned %v at %d, expected %v", what, format(results[i]), i, format(expected[i]))
+		}
+	}
+}
+
+// Equal returns true if both ranges have the same bounds, records, TTL and
+// name servers. A nil list is equal to an empty one.
+func Equal(a, b enum.NumberRange) bool {
+	if !a.Equals(b) || len(a.Records) != len(b.Records) || len(a.NameServers) != len(b.NameServers) {
+		return false
+	}
+	if (a.Ttl == nil) != (b.Ttl == nil) || a.Ttl != nil && *a.Ttl != *b.Ttl {
+		return false
+	}
+	for i := range a.Records {
+		if a.Records[i] != b.Records[i] {
+			return false
+		}
+	}
+	for i := range a.NameServers {
+		x, y := a.NameServers[i], b.NameServers[i]
+		if x.Name != y.Name || len(x.Addresses) != len(y.Addresses) {
+			return false
+		}
+		for j := range x.Addresses {
+			if x.Addresses[j] != y.Addresses[j] {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func format(r enum.NumberRange) string {
+	s := fmt.Sprintf("[%d:%d] (%d records", r.Lower, r.Upper, len(r.Records))
+	if r.Ttl != nil {
+		s += fmt.Sprintf(", ttl %d", *r.Ttl)
+	}
+	if len(r.NameServers) > 0 {
+		s += fmt.Sprintf(", %d name servers", len(r.NameServers))
+	}
+	return s + ")"
+}
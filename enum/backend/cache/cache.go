@@ -0,0 +1,180 @@
+// Copyright 2016 Hadrien Kohl hadrien.kohl@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package cache implements a Backend that caches the lookups of another one.
+package cache
+
+import (
+	"container/list"
+	. "enum-dns/enum"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Stats holds the counters of a caching backend.
+type Stats struct {
+	Hits    uint64 `json:"hits"`
+	Misses  uint64 `json:"misses"`
+	Entries int    `json:"entries"`
+}
+
+type key struct {
+	l, u uint64
+	c    int
+}
+
+type entry struct {
+	key     key
+	ranges  []NumberRange
+	expires time.Time
+}
+
+// CachingBackend keeps the results of RangesBetween in a LRU cache in front of
+// another backend. The cache is emptied by every change made through it, so
+// all the changes have to go through the caching backend.
+type CachingBackend struct {
+	backend Backend
+	size    int
+	ttl     time.Duration
+
+	mu         sync.Mutex
+	entries    map[key]*list.Element
+	lru        *list.List // Most recently used first.
+	generation uint64     // Incremented by every change.
+
+	hits, misses uint64
+}
+
+// NewCachingBackend caches at most size results of b for ttl.
+func NewCachingBackend(b Backend, size int, ttl time.Duration) *CachingBackend {
+	return &CachingBackend{
+		backend: b,
+		size:    size,
+		ttl:     ttl,
+		entries: make(map[key]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+// Stats returns the current counters.
+func (b *CachingBackend) Stats() Stats {
+	b.mu.Lock()
+	entries := b.lru.Len()
+	b.mu.Unlock()
+	return Stats{
+		Hits:    atomic.LoadUint64(&b.hits),
+		Misses:  atomic.LoadUint64(&b.misses),
+		Entries: entries,
+	}
+}
+
+func (b *CachingBackend) RangesBetween(l, u uint64, c int) ([]NumberRange, error) {
+	k := key{l: l, u: u, c: c}
+
+	b.mu.Lock()
+	if e, ok := b.entries[k]; ok {
+		if cached := e.Value.(*entry); time.Now().Before(cached.expires) {
+			b.lru.MoveToFront(e)
+			b.mu.Unlock()
+			atomic.AddUint64(&b.hits, 1)
+			return copyRanges(cached.ranges), nil
+		}
+		b.remove(e)
+	}
+	generation := b.generation
+	b.mu.Unlock()
+
+	atomic.AddUint64(&b.misses, 1)
+	ranges, err := b.backend.RangesBetween(l, u, c)
+	if err != nil {
+		return nil, err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	// The result may be stale if the data changed during the lookup.
+	if generation != b.generation {
+		return ranges, nil
+	}
+	if e, ok := b.entries[k]; ok {
+		b.remove(e)
+	}
+	b.entries[k] = b.lru.PushFront(&entry{key: k, ranges: copyRanges(ranges), expires: time.Now().Add(b.ttl)})
+	for b.lru.Len() > b.size {
+		b.remove(b.lru.Back())
+	}
+	return ranges, nil
+}
+
+func (b *CachingBackend) PushRange(r NumberRange) ([]NumberRange, error) {
+	defer b.invalidate()
+	return b.backend.PushRange(r)
+}
+
+func (b *CachingBackend) GetRange(l, u uint64) (*NumberRange, error) {
+	return b.backend.GetRange(l, u)
+}
+
+func (b *CachingBackend) DeleteRange(l, u uint64) ([]NumberRange, error) {
+	defer b.invalidate()
+	return b.backend.DeleteRange(l, u)
+}
+
+func (b *CachingBackend) Batch(ops []Operation) ([]NumberRange, error) {
+	defer b.invalidate()
+	return b.backend.Batch(ops)
+}
+
+// Observe observes the cached backend. The cache is emptied before f is
+// called so that the holders of l do not read what the change replaced.
+func (b *CachingBackend) Observe(l sync.Locker, f func(events []Event)) func() {
+	return Observe(b.backend, l, func(events []Event) {
+		b.invalidate()
+		f(events)
+	})
+}
+
+// Watch watches the cached backend.
+func (b *CachingBackend) Watch() (<-chan Event, func()) {
+	return Watch(b.backend)
+}
+
+func (b *CachingBackend) Close() error {
+	b.invalidate()
+	return b.backend.Close()
+}
+
+// Empty the cache. A change can modify ranges outside of its own bounds when
+// it trims them, so every entry is removed rather than only the overlapping
+// ones.
+func (b *CachingBackend) invalidate() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.generation++
+	b.entries = make(map[key]*list.Element)
+	b.lru.Init()
+}
+
+func (b *CachingBackend) remove(e *list.Element) {
+	delete(b.entries, e.Value.(*entry).key)
+	b.lru.Remove(e)
+}
+
+// The cached slices are copied so that callers cannot modify them.
+func copyRanges(ranges []NumberRange) []NumberRange {
+	c := make([]NumberRange, len(ranges))
+	copy(c, ranges)
+	return c
+}
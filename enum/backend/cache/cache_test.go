@@ -0,0 +1,113 @@
+// Copyright 2016 Hadrien Kohl hadrien.kohl@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cache
+
+import (
+	. "enum-dns/enum"
+	"enum-dns/enum/backend/backendtest"
+	"enum-dns/enum/backend/memory"
+	"testing"
+	"time"
+)
+
+func newTestBackend(t *testing.T, size int, ttl time.Duration) *CachingBackend {
+	b, err := memory.NewMemoryBackend()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewCachingBackend(b, size, ttl)
+}
+
+func checkStats(t *testing.T, b *CachingBackend, hits, misses uint64, entries int) {
+	if s := b.Stats(); s.Hits != hits || s.Misses != misses || s.Entries != entries {
+		t.Errorf("Stats() returned %+v, expected {Hits:%d Misses:%d Entries:%d}", s, hits, misses, entries)
+	}
+}
+
+func lookup(t *testing.T, b Backend, number uint64) *NumberRange {
+	ranges, err := b.RangesBetween(number, number, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ranges) == 0 {
+		return nil
+	}
+	return &ranges[0]
+}
+
+func Test_Conformance(t *testing.T) {
+	backendtest.TestBackend(t, func() (Backend, error) {
+		b, err := memory.NewMemoryBackend()
+		return NewCachingBackend(b, 100, time.Minute), err
+	})
+}
+
+func Test_HitsAndMisses(t *testing.T) {
+	b := newTestBackend(t, 10, time.Minute)
+	b.PushRange(NumberRange{Lower: 100000000000000, Upper: 199999999999999})
+
+	lookup(t, b, 150000000000000)
+	checkStats(t, b, 0, 1, 1)
+	lookup(t, b, 150000000000000)
+	lookup(t, b, 150000000000000)
+	checkStats(t, b, 2, 1, 1)
+	lookup(t, b, 160000000000000)
+	checkStats(t, b, 2, 2, 2)
+}
+
+func Test_Invalidation(t *testing.T) {
+	b := newTestBackend(t, 10, time.Minute)
+	b.PushRange(NumberRange{Lower: 100000000000000, Upper: 199999999999999})
+
+	if r := lookup(t, b, 120000000000000); r == nil || r.Upper != 199999999999999 {
+		t.Fatalf("lookup returned %v", r)
+	}
+
+	// Trims the cached range without overlapping with the lookup.
+	b.PushRange(NumberRange{Lower: 150000000000000, Upper: 199999999999999})
+	if r := lookup(t, b, 120000000000000); r == nil || r.Upper != 149999999999999 {
+		t.Errorf("lookup after PushRange returned %v", r)
+	}
+
+	b.DeleteRange(100000000000000, 149999999999999)
+	if r := lookup(t, b, 120000000000000); r != nil {
+		t.Errorf("lookup after DeleteRange returned %v", r)
+	}
+
+	b.Batch([]Operation{{Op: PushOperation, Range: NumberRange{Lower: 100000000000000, Upper: 129999999999999}}})
+	if r := lookup(t, b, 120000000000000); r == nil || r.Upper != 129999999999999 {
+		t.Errorf("lookup after Batch returned %v", r)
+	}
+}
+
+func Test_SizeAndTTL(t *testing.T) {
+	b := newTestBackend(t, 2, 50*time.Millisecond)
+	b.PushRange(NumberRange{Lower: 100000000000000, Upper: 199999999999999})
+
+	lookup(t, b, 110000000000000)
+	lookup(t, b, 120000000000000)
+	lookup(t, b, 110000000000000)
+	// Evicts 120000000000000, the least recently used.
+	lookup(t, b, 130000000000000)
+	checkStats(t, b, 1, 3, 2)
+	lookup(t, b, 110000000000000)
+	checkStats(t, b, 2, 3, 2)
+	lookup(t, b, 120000000000000)
+	checkStats(t, b, 2, 4, 2)
+
+	time.Sleep(100 * time.Millisecond)
+	lookup(t, b, 120000000000000)
+	checkStats(t, b, 2, 5, 2)
+}
@@ -0,0 +1,253 @@
+// Copyright 2016 Hadrien Kohl hadrien.kohl@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package layered implements a Backend where exact numbers or narrow ranges
+// override the ranges of a base backend.
+package layered
+
+import (
+	. "enum-dns/enum"
+	"sync"
+)
+
+// LayeredBackend consults the overrides layer before falling back to the
+// base layer. Ported numbers can so be routed on their own without splitting
+// the blocks of the base layer.
+//
+// The methods of the Backend interface change the base layer. The overrides
+// layer is changed through the backend returned by Overrides.
+type LayeredBackend struct {
+	overrides Backend
+	base      Backend
+}
+
+func NewLayeredBackend(overrides, base Backend) *LayeredBackend {
+	return &LayeredBackend{overrides: overrides, base: base}
+}
+
+// Overrides returns the overrides layer.
+func (b *LayeredBackend) Overrides() Backend {
+	return b.overrides
+}
+
+// Base returns the base layer.
+func (b *LayeredBackend) Base() Backend {
+	return b.base
+}
+
+// RangesBetween returns the ranges of the merged layers: the overrides, and
+// what is left of the base ranges around them. A base range with overrides in
+// it is returned in pieces that keep its records. The ranges are ordered and
+// counted like for any backend.
+func (b *LayeredBackend) RangesBetween(l, u uint64, c int) ([]NumberRange, error) {
+	results := make([]NumberRange, 0)
+	if c < 0 {
+		return b.reverse(l, u, c, results)
+	}
+	// The cursor is the first number that the results do not cover yet.
+	cursor := l
+	for len(results) < c {
+		r, err := one(b.base, cursor, u, 1)
+		if err != nil {
+			return nil, err
+		}
+		// The overrides after u can still end the piece of the base range.
+		end := u
+		if r != nil {
+			end = maxKey(u, r.Upper)
+		}
+		o, err := one(b.overrides, cursor, end, 1)
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case r == nil && o == nil:
+			return results, nil
+		case o != nil && (r == nil || o.Lower <= maxKey(r.Lower, cursor)):
+			r = o
+		default:
+			// The piece of the base range starts after the last override
+			// before the cursor, which is the cursor after the first piece.
+			if r.Lower < cursor {
+				if len(results) > 0 {
+					r.Lower = cursor
+				} else if before, err := one(b.overrides, r.Lower, cursor-1, -1); err != nil {
+					return nil, err
+				} else if before != nil {
+					r.Lower = before.Upper + 1
+				}
+			}
+			if o != nil && o.Lower <= r.Upper {
+				r.Upper = o.Lower - 1
+			}
+		}
+		results = append(results, *r)
+		if r.Upper >= u {
+			break
+		}
+		cursor = r.Upper + 1
+	}
+	return results, nil
+}
+
+// RangesBetween in descending order.
+func (b *LayeredBackend) reverse(l, u uint64, c int, results []NumberRange) ([]NumberRange, error) {
+	// The cursor is the last number that the results do not cover yet.
+	cursor := u
+	for len(results) < -c {
+		r, err := one(b.base, l, cursor, -1)
+		if err != nil {
+			return nil, err
+		}
+		start := l
+		if r != nil {
+			start = minKey(l, r.Lower)
+		}
+		o, err := one(b.overrides, start, cursor, -1)
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case r == nil && o == nil:
+			return results, nil
+		case o != nil && (r == nil || o.Upper >= minKey(r.Upper, cursor)):
+			r = o
+		default:
+			if r.Upper > cursor {
+				if len(results) > 0 {
+					r.Upper = cursor
+				} else if after, err := one(b.overrides, cursor+1, r.Upper, 1); err != nil {
+					return nil, err
+				} else if after != nil {
+					r.Upper = after.Lower - 1
+				}
+			}
+			if o != nil && o.Upper >= r.Lower {
+				r.Lower = o.Upper + 1
+			}
+		}
+		results = append(results, *r)
+		if r.Lower <= l {
+			break
+		}
+		cursor = r.Lower - 1
+	}
+	return results, nil
+}
+
+// The first, or last if c is negative, range of the layer between l and u.
+func one(layer Backend, l, u uint64, c int) (*NumberRange, error) {
+	ranges, err := layer.RangesBetween(l, u, c)
+	if err != nil || len(ranges) == 0 {
+		return nil, err
+	}
+	return &ranges[0], nil
+}
+
+func maxKey(a, b uint64) uint64 {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+func minKey(a, b uint64) uint64 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func (b *LayeredBackend) PushRange(r NumberRange) ([]NumberRange, error) {
+	return b.base.PushRange(r)
+}
+
+// GetRange returns the range of the overrides layer with the given bounds, or
+// the one of the base layer if there is none.
+func (b *LayeredBackend) GetRange(l, u uint64) (*NumberRange, error) {
+	r, err := b.overrides.GetRange(l, u)
+	if err != nil || r != nil {
+		return r, err
+	}
+	return b.base.GetRange(l, u)
+}
+
+func (b *LayeredBackend) DeleteRange(l, u uint64) ([]NumberRange, error) {
+	return b.base.DeleteRange(l, u)
+}
+
+func (b *LayeredBackend) Batch(ops []Operation) ([]NumberRange, error) {
+	return b.base.Batch(ops)
+}
+
+// Observe observes both layers. The events of a change are the ones of a
+// layer and so are their change numbers.
+func (b *LayeredBackend) Observe(l sync.Locker, f func(events []Event)) func() {
+	stopOverrides := Observe(b.overrides, l, f)
+	stopBase := Observe(b.base, l, f)
+	return func() {
+		stopOverrides()
+		stopBase()
+	}
+}
+
+// Watch returns the events of both layers. The events of a layer come in
+// order but the events of the two layers are interleaved as they happen. The
+// change numbers of the events are the ones of their layer.
+func (b *LayeredBackend) Watch() (<-chan Event, func()) {
+	events := make(chan Event)
+	stop := make(chan struct{})
+	var once sync.Once
+	cancel := func() { once.Do(func() { close(stop) }) }
+
+	var wg sync.WaitGroup
+	for _, layer := range []Backend{b.overrides, b.base} {
+		ch, unwatch := Watch(layer)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer unwatch()
+			for {
+				select {
+				case e, ok := <-ch:
+					if !ok {
+						// Missed events in one layer, stop both.
+						cancel()
+						return
+					}
+					select {
+					case events <- e:
+					case <-stop:
+						return
+					}
+				case <-stop:
+					return
+				}
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(events)
+	}()
+	return events, cancel
+}
+
+func (b *LayeredBackend) Close() error {
+	err := b.overrides.Close()
+	if berr := b.base.Close(); err == nil {
+		err = berr
+	}
+	return err
+}
@@ -0,0 +1,153 @@
+// Copyright 2016 Hadrien Kohl hadrien.kohl@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package layered
+
+import (
+	. "enum-dns/enum"
+	"enum-dns/enum/backend/backendtest"
+	"enum-dns/enum/backend/memory"
+	"math"
+	"math/rand"
+	"testing"
+)
+
+func newTestBackend() (*LayeredBackend, error) {
+	overrides, err := memory.NewMemoryBackend()
+	if err != nil {
+		return nil, err
+	}
+	base, err := memory.NewMemoryBackend()
+	if err != nil {
+		return nil, err
+	}
+	return NewLayeredBackend(overrides, base), nil
+}
+
+func Test_Conformance(t *testing.T) {
+	backendtest.TestBackend(t, func() (Backend, error) {
+		return newTestBackend()
+	})
+}
+
+func Test_Overrides(t *testing.T) {
+	b, err := newTestBackend()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	block := NumberRange{Lower: 100000000000000, Upper: 199999999999999,
+		Records: []Record{{Service: "E2U+sip", Regexp: "!^(.*)$!sip:\\1@block!"}}}
+	ported := NumberRange{Lower: 150000000000000, Upper: 150000000000000,
+		Records: []Record{{Service: "E2U+sip", Regexp: "!^(.*)$!sip:\\1@ported!"}}}
+	b.PushRange(block)
+	b.Overrides().PushRange(ported)
+
+	// The pieces of the block around the override.
+	before, after := block, block
+	before.Upper, after.Lower = ported.Lower-1, ported.Upper+1
+
+	tt := []struct {
+		l, u uint64
+		c    int
+		exp  []NumberRange
+	}{
+		{150000000000000, 150000000000000, 1, []NumberRange{ported}},
+		{150000000000001, 150000000000001, 1, []NumberRange{after}},
+		{149999999999999, 149999999999999, 1, []NumberRange{before}},
+		{100000000000000, 199999999999999, 10, []NumberRange{before, ported, after}},
+		{100000000000000, 199999999999999, -10, []NumberRange{after, ported, before}},
+		{100000000000000, 199999999999999, -1, []NumberRange{after}},
+		{100000000000000, 199999999999999, 2, []NumberRange{before, ported}},
+		{200000000000000, 299999999999999, 1, []NumberRange{}},
+	}
+	for _, v := range tt {
+		results, err := b.RangesBetween(v.l, v.u, v.c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(results) != len(v.exp) {
+			t.Errorf("RangesBetween(%d, %d, %d) returned %d ranges, expected %d", v.l, v.u, v.c, len(results), len(v.exp))
+			continue
+		}
+		for i := range results {
+			if !backendtest.Equal(results[i], v.exp[i]) || results[i].Records[0] != v.exp[i].Records[0] {
+				t.Errorf("RangesBetween(%d, %d, %d) returned %v at %d, expected %v", v.l, v.u, v.c, results[i], i, v.exp[i])
+			}
+		}
+	}
+
+	// The block is not fragmented by the override.
+	if r, _ := b.Base().GetRange(block.Lower, block.Upper); r == nil {
+		t.Errorf("the block was modified by the override")
+	}
+	if r, _ := b.GetRange(ported.Lower, ported.Upper); r == nil || !backendtest.Equal(*r, ported) {
+		t.Errorf("GetRange(%d, %d) returned %v, expected %v", ported.Lower, ported.Upper, r, ported)
+	}
+
+	// Removing the override brings the block back.
+	b.Overrides().DeleteRange(ported.Lower, ported.Upper)
+	results, _ := b.RangesBetween(ported.Lower, ported.Upper, 1)
+	if len(results) != 1 || !backendtest.Equal(results[0], block) {
+		t.Errorf("RangesBetween(%d, %d, 1) returned %v after the override was deleted", ported.Lower, ported.Upper, results)
+	}
+}
+
+// The layers are merged like the overrides pushed on top of the base ranges.
+func Test_Merged(t *testing.T) {
+	b, err := newTestBackend()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	reference, _ := memory.NewMemoryBackend()
+	defer reference.Close()
+
+	r := rand.New(rand.NewSource(1))
+	random := func(size int64) NumberRange {
+		lower := 100000000000000 + uint64(r.Int63n(1000000-size))
+		return NumberRange{Lower: lower, Upper: lower + uint64(r.Int63n(size))}
+	}
+	for i := 0; i < 50; i++ {
+		base := random(50000)
+		b.PushRange(base)
+		reference.PushRange(base)
+	}
+	for i := 0; i < 50; i++ {
+		b.Overrides().PushRange(random(5000))
+	}
+	overrides, _ := b.Overrides().RangesBetween(0, math.MaxInt64, 1000)
+	for _, o := range overrides {
+		reference.PushRange(o)
+	}
+
+	for i := 0; i < 1000; i++ {
+		q := random(100000)
+		c := r.Intn(20) - 10
+		results, err := b.RangesBetween(q.Lower, q.Upper, c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected, _ := reference.RangesBetween(q.Lower, q.Upper, c)
+		if len(results) != len(expected) {
+			t.Fatalf("RangesBetween(%d, %d, %d) returned %v, expected %v", q.Lower, q.Upper, c, results, expected)
+		}
+		for k := range results {
+			if !results[k].Equals(expected[k]) {
+				t.Fatalf("RangesBetween(%d, %d, %d) returned %v, expected %v", q.Lower, q.Upper, c, results, expected)
+			}
+		}
+	}
+}
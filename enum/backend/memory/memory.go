@@ -18,92 +18,351 @@ import (
 	. "enum-dns/enum"
 	"fmt"
 	"sort"
+	"sync"
+	"sync/atomic"
 )
 
+// Maximum number of entries of a chunk of the storage.
+const chunkSize = 256
+
+// storage keeps the ranges sorted by lower bound. Since ranges never overlap,
+// they are sorted by upper bound as well and can be binary searched on both.
+// The entries are split in chunks that are never modified, so that a change
+// only copies the chunks it touches and the list of chunks.
 type storage struct {
-	entries []NumberRange
+	chunks [][]NumberRange
+	// Number of entries up to the end of each chunk.
+	ends []int
+}
+
+// Returns a storage with the sorted entries.
+func newStorage(entries []NumberRange) *storage {
+	s := &storage{}
+	s.chunks = split(entries)
+	s.index()
+	return s
+}
+
+// Split the entries in chunks of at most chunkSize entries of similar sizes.
+func split(entries []NumberRange) [][]NumberRange {
+	n := (len(entries) + chunkSize - 1) / chunkSize
+	chunks := make([][]NumberRange, 0, n)
+	for k := 0; k < n; k++ {
+		chunks = append(chunks, entries[k*len(entries)/n:(k+1)*len(entries)/n])
+	}
+	return chunks
+}
+
+// Compute the ends of the chunks.
+func (s *storage) index() {
+	s.ends = make([]int, len(s.chunks))
+	end := 0
+	for k, chunk := range s.chunks {
+		end += len(chunk)
+		s.ends[k] = end
+	}
+}
+
+// Number of entries.
+func (s *storage) len() int {
+	if len(s.ends) == 0 {
+		return 0
+	}
+	return s.ends[len(s.ends)-1]
+}
+
+// Index of the chunk of entry i, or of the last chunk if i is the end.
+func (s *storage) chunk(i int) int {
+	k := sort.SearchInts(s.ends, i+1)
+	if k == len(s.chunks) && k > 0 {
+		k--
+	}
+	return k
+}
+
+// Index of the first entry of chunk k.
+func (s *storage) start(k int) int {
+	if k == 0 {
+		return 0
+	}
+	return s.ends[k-1]
+}
+
+// Entry i.
+func (s *storage) at(i int) NumberRange {
+	k := s.chunk(i)
+	return s.chunks[k][i-s.start(k)]
+}
+
+// Copy of every entry.
+func (s *storage) all() []NumberRange {
+	entries := make([]NumberRange, 0, s.len())
+	for _, chunk := range s.chunks {
+		entries = append(entries, chunk...)
+	}
+	return entries
+}
+
+// Index of the first entry matching the condition, true for the entries
+// after it as well.
+func (s *storage) search(f func(NumberRange) bool) int {
+	k := sort.Search(len(s.chunks), func(k int) bool {
+		chunk := s.chunks[k]
+		return f(chunk[len(chunk)-1])
+	})
+	if k == len(s.chunks) {
+		return s.len()
+	}
+	chunk := s.chunks[k]
+	return s.start(k) + sort.Search(len(chunk), func(i int) bool { return f(chunk[i]) })
+}
+
+// Index of the first entry whose upper bound is greater or equal to n.
+func (s *storage) first(n uint64) int {
+	return s.search(func(r NumberRange) bool { return r.Upper >= n })
+}
+
+// Index of the first entry whose lower bound is greater than n.
+func (s *storage) after(n uint64) int {
+	return s.search(func(r NumberRange) bool { return r.Lower > n })
+}
+
+// Returns a copy of the storage where the entries i to j (excluded) are
+// replaced with the given ranges. Only the chunks of these entries are
+// copied, with the next one if they become too small.
+func (s *storage) splice(i, j int, ranges []NumberRange) *storage {
+	if len(s.chunks) == 0 {
+		return newStorage(append([]NumberRange(nil), ranges...))
+	}
+	first, last := s.chunk(i), s.chunk(j-1)
+	if j <= i {
+		last = first
+	}
+	start := s.start(first)
+	n := s.ends[last] - start - (j - i) + len(ranges)
+	if n < chunkSize/2 && last+1 < len(s.chunks) {
+		last++
+		n += len(s.chunks[last])
+	}
+
+	entries := make([]NumberRange, 0, n)
+	entries = append(entries, s.chunks[first][:i-start]...)
+	entries = append(entries, ranges...)
+	for k := first; k <= last; k++ {
+		if from := j - s.start(k); from < len(s.chunks[k]) {
+			if from < 0 {
+				from = 0
+			}
+			entries = append(entries, s.chunks[k][from:]...)
+		}
+	}
+
+	pieces := split(entries)
+	chunks := make([][]NumberRange, 0, len(s.chunks)-(last-first+1)+len(pieces))
+	chunks = append(chunks, s.chunks[:first]...)
+	chunks = append(chunks, pieces...)
+	chunks = append(chunks, s.chunks[last+1:]...)
+	c := &storage{chunks: chunks}
+	c.index()
+	return c
+}
+
+// Returns a copy of the storage where the numbers of r are replaced with the
+// given ranges, and the ranges that were overlapping with r.
+func (s *storage) replace(r NumberRange, with ...NumberRange) (*storage, []NumberRange) {
+	i, j := s.first(r.Lower), s.after(r.Upper)
+	results := make([]NumberRange, 0, j-i)
+	for k := i; k < j; k++ {
+		results = append(results, s.at(k))
+	}
+
+	// Only the first and last overlapping entries can stick out of r,
+	// everything in between is deleted.
+	ranges := make([]NumberRange, 0, len(with)+2)
+	if i < j && results[0].Lower < r.Lower {
+		ranges = append(ranges, results[0].Subtract(r)[0])
+	}
+	ranges = append(ranges, with...)
+	if i < j && results[j-i-1].Upper > r.Upper {
+		rest := results[j-i-1].Subtract(r)
+		ranges = append(ranges, rest[len(rest)-1])
+	}
+	return s.splice(i, j, ranges), results
+}
+
+func (s *storage) push(add NumberRange) (*storage, []NumberRange) {
+	return s.replace(add, add)
+}
+
+func (s *storage) delete(r NumberRange) (*storage, []NumberRange) {
+	return s.replace(r)
 }
 
-type Asc []NumberRange
+// Returns a copy of the storage with the operation applied, the ranges that
+// were overlapping with it and the events of the change.
+func (s *storage) apply(op Operation) (*storage, []NumberRange, []Event, error) {
+	switch op.Op {
+	case PushOperation:
+		s, results := s.push(op.Range)
+		return s, results, Events(op.Range, results, op.Range), nil
+	case DeleteOperation:
+		s, results := s.delete(op.Range)
+		return s, results, Events(op.Range, results), nil
+	default:
+		return nil, nil, nil, fmt.Errorf("unknown operation %q", op.Op)
+	}
+}
+
+// Returns a copy of the storage with the operations applied in order, what
+// each of them returned and their events.
+func (s *storage) batch(ops []Operation) (*storage, []NumberRange, []Event, error) {
+	results := make([]NumberRange, 0)
+	events := make([]Event, 0)
+	for _, op := range ops {
+		var overlaps []NumberRange
+		var changes []Event
+		var err error
+		if s, overlaps, changes, err = s.apply(op); err != nil {
+			return nil, nil, nil, err
+		}
+		results = append(results, overlaps...)
+		events = append(events, changes...)
+	}
+	return s, results, events, nil
+}
 
-func (a Asc) Len() int           { return len(a) }
-func (a Asc) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
-func (a Asc) Less(i, j int) bool { return a[i].Lower < a[j].Lower }
+// Returns a copy of the storage with the journal operation applied.
+func (s *storage) replay(op operation) (*storage, []NumberRange, []Event, error) {
+	if op.Op == batchOperation {
+		return s.batch(op.Batch)
+	}
+	return s.apply(op.Operation)
+}
 
+// memoryBackend is safe for concurrent use. The storage is never modified
+// once published; readers load the current one without locking while writers
+// serialize on the mutex and atomically swap in a modified copy. The copy is
+// committed under the mutex as well so the changes are observed in order.
 type memoryBackend struct {
-	s *storage
+	s  atomic.Value // *storage
+	mu sync.Mutex
+	p  *persistence // nil if the backend is not persisted.
+
+	Notifier
+}
+
+func newMemoryBackend(entries []NumberRange) *memoryBackend {
+	b := &memoryBackend{}
+	b.s.Store(newStorage(entries))
+	return b
+}
+
+func (b *memoryBackend) storage() *storage {
+	return b.s.Load().(*storage)
 }
 
 func NewMemoryBackend() (Backend, error) {
-	// TODO: Investigate this black magic...
-	return &memoryBackend{s: &storage{entries: make([]NumberRange, 0)}}, nil
+	return newMemoryBackend(make([]NumberRange, 0)), nil
 }
 
 func (b *memoryBackend) RangesBetween(l, u uint64, c int) ([]NumberRange, error) {
 	results := make([]NumberRange, 0)
-	r := NumberRange{Lower: l, Upper: u}
+	s := b.storage()
+	// Entries i to j (excluded) are the ones overlapping with [l:u].
+	i, j := s.first(l), s.after(u)
 	switch {
 	case c < 0:
-		for i := len(b.s.entries) - 1; i >= 0 && c != 0; i-- {
-			if entry := b.s.entries[i]; entry.OverlapWith(r) {
-				results = append(results, entry)
-				c++
-			}
+		for k := j - 1; k >= i && c != 0; k-- {
+			results = append(results, s.at(k))
+			c++
 		}
 	case c > 0:
-		for i := 0; i < len(b.s.entries) && c != 0; i++ {
-			if entry := b.s.entries[i]; entry.OverlapWith(r) {
-				results = append(results, entry)
-				c--
-			}
+		for k := i; k < j && c != 0; k++ {
+			results = append(results, s.at(k))
+			c--
 		}
 	}
 	return results, nil
 }
 
 func (b *memoryBackend) PushRange(add NumberRange) ([]NumberRange, error) {
-	l, err := PrefixToE164(add.Lower)
-	if err != nil {
+	op := Operation{Op: PushOperation, Range: add}
+	if err := op.Range.Check(); err != nil {
 		return nil, err
 	}
-	u, err := PrefixToE164(add.Upper)
-	if err != nil {
+	return b.update(operation{Operation: op})
+}
+
+func (b *memoryBackend) GetRange(l, u uint64) (*NumberRange, error) {
+	s := b.storage()
+	if i := s.first(l); i < s.len() {
+		if r := s.at(i); r.Lower == l && r.Upper == u {
+			return &r, nil
+		}
+	}
+	return nil, nil
+}
+
+func (b *memoryBackend) DeleteRange(l, u uint64) ([]NumberRange, error) {
+	op := Operation{Op: DeleteOperation, Range: NumberRange{Lower: l, Upper: u}}
+	if err := op.Range.Check(); err != nil {
 		return nil, err
 	}
+	return b.update(operation{Operation: op})
+}
 
-	results := make([]NumberRange, 0)
-	for i := len(b.s.entries) - 1; i >= 0; i-- {
-		entry := &b.s.entries[i]
-		fmt.Printf("checking [%d:%d] against [%d:%d] \n", entry.Lower, entry.Upper, add.Lower, add.Upper)
-		if add.Contains(*entry) {
-			b.s.entries = append(b.s.entries[:i], b.s.entries[i+1:]...)
-			fmt.Printf("delete [%d:%d]\n", entry.Lower, entry.Upper)
-			results = append(results, *entry)
-		} else if entry.OverlapWith(add) {
-			if entry.Lower <= add.Upper && add.Upper <= entry.Upper {
-				fmt.Printf("adjust [%d:%d] to [%d:%d]\n", entry.Lower, entry.Upper, add.Upper+1, entry.Upper)
-				entry.Lower = add.Upper + 1
-			}
-			if entry.Lower <= add.Lower && add.Lower <= entry.Upper {
-				fmt.Printf("adjust [%d:%d] to [%d:%d]\n", entry.Lower, entry.Upper, entry.Lower, add.Lower-1)
-				entry.Upper = add.Lower - 1
-			}
+func (b *memoryBackend) Batch(ops []Operation) ([]NumberRange, error) {
+	for _, op := range ops {
+		if err := op.Range.Check(); err != nil {
+			return nil, err
 		}
 	}
+	batch := make([]Operation, len(ops))
+	copy(batch, ops)
+	return b.update(operation{Operation: Operation{Op: batchOperation}, Batch: batch})
+}
 
-	add.Lower = l
-	add.Upper = u
-	fmt.Printf("adding [%d:%d]\n", add.Lower, add.Upper)
-	b.s.entries = append(b.s.entries, add)
-	sort.Sort(Asc(b.s.entries))
+// Apply the operation and publish the resulting storage.
+func (b *memoryBackend) update(op operation) ([]NumberRange, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
 
-	for _, v := range b.s.entries {
-		fmt.Printf("end result: [%d:%d]\n", v.Lower, v.Upper)
+	if b.p != nil && b.p.err != nil {
+		// The last periodic snapshot failed: try again before taking more
+		// changes that may not be saved either.
+		if b.p.err = b.p.snapshot(b.storage()); b.p.err != nil {
+			return nil, fmt.Errorf("snapshot: %v", b.p.err)
+		}
+	}
+	s, results, events, err := b.storage().replay(op)
+	if err != nil {
+		return nil, err
+	}
+	if b.p != nil {
+		// The change is journaled before being visible.
+		if err := b.p.append(op); err != nil {
+			return nil, err
+		}
+	}
+	b.Commit(func() error {
+		b.s.Store(s)
+		return nil
+	}, events...)
+	if b.p != nil && b.p.interval == 0 {
+		if err := b.p.snapshot(s); err != nil {
+			return results, err
+		}
 	}
 
 	return results, nil
 }
 
 func (b *memoryBackend) Close() error {
-	return nil
+	if b.p == nil {
+		return nil
+	}
+	b.p.stopSnapshots()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.p.close(b.storage())
 }
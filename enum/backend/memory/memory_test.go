@@ -0,0 +1,302 @@
+// Copyright 2016 Hadrien Kohl hadrien.kohl@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package memory
+
+import (
+	. "enum-dns/enum"
+	"enum-dns/enum/backend/backendtest"
+	"fmt"
+	"math/rand"
+	"sort"
+	"sync"
+	"testing"
+)
+
+// linearBackend is the previous implementation of the memory backend. It is
+// used as a reference in the tests and as a baseline in the benchmarks.
+type linearBackend struct {
+	entries []NumberRange
+}
+
+func (b *linearBackend) RangesBetween(l, u uint64, c int) ([]NumberRange, error) {
+	results := make([]NumberRange, 0)
+	r := NumberRange{Lower: l, Upper: u}
+	switch {
+	case c < 0:
+		for i := len(b.entries) - 1; i >= 0 && c != 0; i-- {
+			if entry := b.entries[i]; entry.OverlapWith(r) {
+				results = append(results, entry)
+				c++
+			}
+		}
+	case c > 0:
+		for i := 0; i < len(b.entries) && c != 0; i++ {
+			if entry := b.entries[i]; entry.OverlapWith(r) {
+				results = append(results, entry)
+				c--
+			}
+		}
+	}
+	return results, nil
+}
+
+func (b *linearBackend) PushRange(add NumberRange) ([]NumberRange, error) {
+	results := make([]NumberRange, 0)
+	entries := make([]NumberRange, 0, len(b.entries)+2)
+	for _, entry := range b.entries {
+		if entry.OverlapWith(add) {
+			results = append(results, entry)
+		}
+		entries = append(entries, entry.Subtract(add)...)
+	}
+	b.entries = append(entries, add)
+	sort.Sort(asc(b.entries))
+	return results, nil
+}
+
+func (b *linearBackend) GetRange(l, u uint64) (*NumberRange, error) {
+	for _, entry := range b.entries {
+		if entry.Lower == l && entry.Upper == u {
+			return &entry, nil
+		}
+	}
+	return nil, nil
+}
+
+func (b *linearBackend) DeleteRange(l, u uint64) ([]NumberRange, error) {
+	r := NumberRange{Lower: l, Upper: u}
+	results := make([]NumberRange, 0)
+	entries := make([]NumberRange, 0, len(b.entries)+1)
+	for _, entry := range b.entries {
+		if entry.OverlapWith(r) {
+			results = append(results, entry)
+		}
+		entries = append(entries, entry.Subtract(r)...)
+	}
+	b.entries = entries
+	return results, nil
+}
+
+func (b *linearBackend) Batch(ops []Operation) ([]NumberRange, error) {
+	entries := b.entries
+	results := make([]NumberRange, 0)
+	for _, op := range ops {
+		var overlaps []NumberRange
+		switch op.Op {
+		case PushOperation:
+			overlaps, _ = b.PushRange(op.Range)
+		case DeleteOperation:
+			overlaps, _ = b.DeleteRange(op.Range.Lower, op.Range.Upper)
+		default:
+			b.entries = entries
+			return nil, fmt.Errorf("unknown operation %q", op.Op)
+		}
+		results = append(results, overlaps...)
+	}
+	return results, nil
+}
+
+func (b *linearBackend) Close() error {
+	return nil
+}
+
+type asc []NumberRange
+
+func (a asc) Len() int           { return len(a) }
+func (a asc) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a asc) Less(i, j int) bool { return a[i].Lower < a[j].Lower }
+
+func randomRange(r *rand.Rand, size uint64) NumberRange {
+	lower := 100000000000000 + uint64(r.Int63n(899999999999999-int64(size)))
+	return NumberRange{Lower: lower, Upper: lower + uint64(r.Int63n(int64(size)))}
+}
+
+func sameRanges(a, b []NumberRange) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !a[i].Equals(b[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func Test_AgainstLinear(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	b, _ := NewMemoryBackend()
+	reference := &linearBackend{}
+
+	for i := 0; i < 2000; i++ {
+		add := randomRange(r, 10000000000000)
+		if i%5 == 0 {
+			results, _ := b.DeleteRange(add.Lower, add.Upper)
+			expected, _ := reference.DeleteRange(add.Lower, add.Upper)
+			if !sameRanges(results, expected) {
+				t.Fatalf("DeleteRange(%d, %d) returned %v, expected %v", add.Lower, add.Upper, results, expected)
+			}
+		} else {
+			results, _ := b.PushRange(add)
+			expected, _ := reference.PushRange(add)
+			if !sameRanges(results, expected) {
+				t.Fatalf("PushRange([%d:%d]) returned %v, expected %v", add.Lower, add.Upper, results, expected)
+			}
+		}
+
+		for k := 0; k < len(reference.entries) && k < 3; k++ {
+			e := reference.entries[k]
+			if result, _ := b.GetRange(e.Lower, e.Upper); result == nil || !result.Equals(e) {
+				t.Fatalf("GetRange(%d, %d) returned %v", e.Lower, e.Upper, result)
+			}
+			if result, _ := b.GetRange(e.Lower, e.Upper+1); result != nil {
+				t.Fatalf("GetRange(%d, %d) returned %v, expected nil", e.Lower, e.Upper+1, result)
+			}
+		}
+
+		query := randomRange(r, 100000000000000)
+		for _, c := range []int{1, 5, -5, 1000} {
+			results, _ := b.RangesBetween(query.Lower, query.Upper, c)
+			expected, _ := reference.RangesBetween(query.Lower, query.Upper, c)
+			if !sameRanges(results, expected) {
+				t.Fatalf("RangesBetween(%d, %d, %d) returned %v, expected %v",
+					query.Lower, query.Upper, c, results, expected)
+			}
+		}
+	}
+}
+
+// Consecutive ranges of 1000 numbers.
+func consecutive(n int) []NumberRange {
+	entries := make([]NumberRange, n)
+	for i := range entries {
+		entries[i].Lower = 100000000000000 + uint64(i)*1000
+		entries[i].Upper = entries[i].Lower + 999
+	}
+	return entries
+}
+
+func benchmarkRangesBetween(bench *testing.B, b Backend, n int) {
+	r := rand.New(rand.NewSource(1))
+	bench.ResetTimer()
+	for i := 0; i < bench.N; i++ {
+		number := 100000000000000 + uint64(r.Int63n(int64(n)*1000))
+		b.RangesBetween(number, number, 1)
+	}
+}
+
+func benchmarkPushRange(bench *testing.B, b Backend, n int) {
+	r := rand.New(rand.NewSource(1))
+	bench.ResetTimer()
+	for i := 0; i < bench.N; i++ {
+		lower := 100000000000000 + uint64(r.Int63n(int64(n)*1000))
+		b.PushRange(NumberRange{Lower: lower, Upper: lower + 1500})
+	}
+}
+
+func BenchmarkRangesBetween(bench *testing.B) {
+	b := newMemoryBackend(consecutive(100000))
+	benchmarkRangesBetween(bench, b, 100000)
+}
+
+func BenchmarkLinearRangesBetween(bench *testing.B) {
+	benchmarkRangesBetween(bench, &linearBackend{entries: consecutive(100000)}, 100000)
+}
+
+func BenchmarkPushRange(bench *testing.B) {
+	b := newMemoryBackend(consecutive(100000))
+	benchmarkPushRange(bench, b, 100000)
+}
+
+func BenchmarkLinearPushRange(bench *testing.B) {
+	benchmarkPushRange(bench, &linearBackend{entries: consecutive(100000)}, 100000)
+}
+
+// Load 100000 ranges in an empty backend, one by one or in a single batch.
+func BenchmarkLoad(bench *testing.B) {
+	ranges := consecutive(100000)
+	for i := 0; i < bench.N; i++ {
+		b, _ := NewMemoryBackend()
+		for _, r := range ranges {
+			b.PushRange(r)
+		}
+	}
+}
+
+func BenchmarkLoadBatch(bench *testing.B) {
+	ops := make([]Operation, 0, 100000)
+	for _, r := range consecutive(100000) {
+		ops = append(ops, Operation{Op: PushOperation, Range: r})
+	}
+	for i := 0; i < bench.N; i++ {
+		b, _ := NewMemoryBackend()
+		b.Batch(ops)
+	}
+}
+
+// Run with -race to detect unsafe accesses.
+func Test_Concurrent(t *testing.T) {
+	b := newMemoryBackend(consecutive(1000))
+
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(seed int64) {
+			defer wg.Done()
+			r := rand.New(rand.NewSource(seed))
+			for i := 0; i < 500; i++ {
+				b.PushRange(randomRange(r, 10000000))
+			}
+		}(int64(w))
+	}
+
+	var readers sync.WaitGroup
+	for w := 0; w < 8; w++ {
+		readers.Add(1)
+		go func(seed int64) {
+			defer readers.Done()
+			r := rand.New(rand.NewSource(seed))
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				query := randomRange(r, 100000000)
+				results, err := b.RangesBetween(query.Lower, query.Upper, 100)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				for i := 1; i < len(results); i++ {
+					if results[i-1].Upper >= results[i].Lower {
+						t.Errorf("[%d:%d] overlaps with [%d:%d]",
+							results[i-1].Lower, results[i-1].Upper, results[i].Lower, results[i].Upper)
+						return
+					}
+				}
+			}
+		}(int64(w))
+	}
+
+	wg.Wait()
+	close(done)
+	readers.Wait()
+}
+
+func Test_Conformance(t *testing.T) {
+	backendtest.TestBackend(t, NewMemoryBackend)
+}
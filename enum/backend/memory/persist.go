@@ -0,0 +1,337 @@
+// Copyright 2016 Hadrien Kohl hadrien.kohl@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package memory
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	. "enum-dns/enum"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Version of the snapshot and journal files. It has to be incremented when
+// the format changes in a way older files cannot be read as is anymore.
+// Version 2 writes the bounds of the ranges as strings of digits; the numbers
+// of version 1 are still read as 15 digits numbers.
+const formatVersion = 2
+
+// Oldest version of the files that can be read.
+const minFormatVersion = 1
+
+const (
+	snapshotFile = "snapshot.json"
+	journalFile  = "journal.json"
+)
+
+// snapshotContent is the content of the snapshot file.
+type snapshotContent struct {
+	Version int `json:"version"`
+	// Sequence of the last journaled operation included in the snapshot.
+	Sequence uint64        `json:"sequence"`
+	Ranges   []NumberRange `json:"ranges"`
+}
+
+// The journal starts with a header line followed by one operation per line.
+type journalHeader struct {
+	Version int `json:"version"`
+}
+
+// A batch is journaled as a single operation holding the operations of the
+// batch so that it is replayed all or nothing.
+const batchOperation = "batch"
+
+type operation struct {
+	Sequence uint64 `json:"sequence"`
+	Operation
+	Batch []Operation `json:"batch,omitempty"`
+}
+
+// persistence keeps the snapshot and journal files of a memory backend. It is
+// protected by the mutex of the backend.
+type persistence struct {
+	dir      string
+	interval time.Duration
+
+	journal *os.File
+	size    int64  // Size of the journal after the last complete operation.
+	last    uint64 // Sequence of the last journaled operation.
+	saved   uint64 // Sequence of the last operation in the snapshot.
+	err     error  // Error of the last periodic snapshot.
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// NewPersistentMemoryBackend creates a memory backend that is loaded from and
+// saved to the directory dir.
+//
+// Every change is appended to a journal before it becomes visible so that
+// nothing is lost if the process crashes. The journal is compacted into a
+// snapshot every interval, after each change if interval is zero, and when the
+// backend is closed.
+func NewPersistentMemoryBackend(dir string, interval time.Duration) (Backend, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	content, err := readSnapshot(filepath.Join(dir, snapshotFile))
+	if err != nil {
+		return nil, err
+	}
+	operations, err := readJournal(filepath.Join(dir, journalFile))
+	if err != nil {
+		return nil, err
+	}
+
+	p := &persistence{dir: dir, interval: interval, last: content.Sequence}
+	s := newStorage(content.Ranges)
+	for _, op := range operations {
+		// Already in the snapshot.
+		if op.Sequence <= p.last {
+			continue
+		}
+		if s, _, _, err = s.replay(op); err != nil {
+			return nil, fmt.Errorf("journal: %v", err)
+		}
+		p.last = op.Sequence
+	}
+
+	// Start from a fresh snapshot and an empty journal. This also gets rid of
+	// an operation that was only partially written.
+	if err := p.snapshot(s); err != nil {
+		return nil, err
+	}
+
+	b := newMemoryBackend(s.all())
+	b.p = p
+	if interval > 0 {
+		p.stop = make(chan struct{})
+		p.done = make(chan struct{})
+		go b.snapshotEvery(interval)
+	}
+	return b, nil
+}
+
+func (b *memoryBackend) snapshotEvery(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	defer close(b.p.done)
+	for {
+		select {
+		case <-ticker.C:
+			b.mu.Lock()
+			// The journal still holds the operations if this fails. The
+			// next change tries again and fails with the error if it
+			// cannot be saved, as does Close.
+			b.p.err = b.p.snapshot(b.storage())
+			b.mu.Unlock()
+		case <-b.p.stop:
+			return
+		}
+	}
+}
+
+func (p *persistence) stopSnapshots() {
+	if p.stop != nil {
+		close(p.stop)
+		<-p.done
+		p.stop = nil
+	}
+}
+
+// Append an operation to the journal and wait until it is on disk.
+func (p *persistence) append(op operation) error {
+	op.Sequence = p.last + 1
+	line, err := json.Marshal(op)
+	if err != nil {
+		return err
+	}
+	n, err := p.journal.Write(append(line, '\n'))
+	if err == nil {
+		err = p.journal.Sync()
+	}
+	if err != nil {
+		// Do not leave a partial operation in the middle of the journal.
+		p.journal.Truncate(p.size)
+		return err
+	}
+	p.size += int64(n)
+	p.last = op.Sequence
+	return nil
+}
+
+// Write the storage to the snapshot file and start a new journal.
+func (p *persistence) snapshot(s *storage) error {
+	if p.journal != nil && p.saved == p.last {
+		return nil
+	}
+
+	content := snapshotContent{Version: formatVersion, Sequence: p.last, Ranges: s.all()}
+	if err := writeFile(filepath.Join(p.dir, snapshotFile), func(w io.Writer) error {
+		return json.NewEncoder(w).Encode(content)
+	}); err != nil {
+		return err
+	}
+	p.saved = p.last
+
+	// The snapshot holds the sequence of the last operation so a crash at
+	// this point only replays operations that are skipped. The new journal is
+	// opened before it replaces the old one, which is kept if anything fails.
+	name := filepath.Join(p.dir, journalFile)
+	tmp := name + ".tmp"
+	if err := writeTemp(tmp, func(w io.Writer) error {
+		return json.NewEncoder(w).Encode(journalHeader{Version: formatVersion})
+	}); err != nil {
+		return err
+	}
+	journal, err := os.OpenFile(tmp, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	info, err := journal.Stat()
+	if err == nil {
+		err = os.Rename(tmp, name)
+	}
+	if err != nil {
+		journal.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if p.journal != nil {
+		p.journal.Close()
+	}
+	p.journal, p.size = journal, info.Size()
+	return nil
+}
+
+func (p *persistence) close(s *storage) error {
+	err := p.snapshot(s)
+	if p.journal != nil {
+		p.journal.Close()
+		p.journal = nil
+	}
+	if err == nil {
+		err = p.err
+	}
+	return err
+}
+
+// Atomically replace the file name with what fn writes.
+func writeFile(name string, fn func(w io.Writer) error) error {
+	tmp := name + ".tmp"
+	if err := writeTemp(tmp, fn); err != nil {
+		return err
+	}
+	return os.Rename(tmp, name)
+}
+
+// Write the file tmp with fn and sync it. It is removed if anything fails.
+func writeTemp(tmp string, fn func(w io.Writer) error) error {
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	if err = fn(w); err == nil {
+		if err = w.Flush(); err == nil {
+			err = f.Sync()
+		}
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
+
+func readSnapshot(name string) (*snapshotContent, error) {
+	content := &snapshotContent{Version: formatVersion, Ranges: make([]NumberRange, 0)}
+	f, err := os.Open(name)
+	if os.IsNotExist(err) {
+		return content, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	if err := json.NewDecoder(bufio.NewReader(f)).Decode(content); err != nil {
+		return nil, fmt.Errorf("snapshot: %v", err)
+	}
+	if content.Version < minFormatVersion || content.Version > formatVersion {
+		return nil, fmt.Errorf("snapshot: unsupported version %d", content.Version)
+	}
+	if content.Ranges == nil {
+		content.Ranges = make([]NumberRange, 0)
+	}
+	return content, nil
+}
+
+func readJournal(name string) ([]operation, error) {
+	f, err := os.Open(name)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	line, err := r.ReadBytes('\n')
+	if err == io.EOF {
+		// Crashed before the header was written.
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var h journalHeader
+	if err := json.Unmarshal(line, &h); err != nil {
+		return nil, fmt.Errorf("journal: %v", err)
+	}
+	if h.Version < minFormatVersion || h.Version > formatVersion {
+		return nil, fmt.Errorf("journal: unsupported version %d", h.Version)
+	}
+
+	operations := make([]operation, 0)
+	for {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			// A last line without new line was not completely written
+			// and its operation never took effect.
+			return operations, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		var op operation
+		if err := json.Unmarshal(line, &op); err != nil {
+			return nil, fmt.Errorf("journal: %v", err)
+		}
+		operations = append(operations, op)
+	}
+}
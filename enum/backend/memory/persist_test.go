@@ -0,0 +1,242 @@
+// Copyright 2016 Hadrien Kohl hadrien.kohl@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package memory
+
+import (
+	. "enum-dns/enum"
+	"enum-dns/enum/backend/backendtest"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+var persisted = []NumberRange{
+	{Lower: 100000000000000, Upper: 199999999999999, Records: []Record{
+		{Order: 10, Preference: 100, Service: "E2U+sip", Regexp: "!^(.*)$!sip:\\1@first!", Replacement: "."},
+	}},
+	{Lower: 200000000000000, Upper: 299999999999999},
+	{Lower: 150000000000000, Upper: 250000000000000},
+}
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "enum-memory")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func checkPersisted(t *testing.T, b Backend) {
+	results, err := b.RangesBetween(100000000000000, 999999999999999, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []NumberRange{
+		{Lower: 100000000000000, Upper: 149999999999999},
+		{Lower: 150000000000000, Upper: 250000000000000},
+		{Lower: 250000000000001, Upper: 299999999999999},
+	}
+	if !sameRanges(results, expected) {
+		t.Fatalf("loaded %v, expected %v", results, expected)
+	}
+	if len(results[0].Records) != 1 || results[0].Records[0] != persisted[0].Records[0] {
+		t.Errorf("loaded records %v, expected %v", results[0].Records, persisted[0].Records)
+	}
+}
+
+func Test_PersistenceConformance(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	n := 0
+	backendtest.TestBackend(t, func() (Backend, error) {
+		n++
+		return NewPersistentMemoryBackend(filepath.Join(dir, strconv.Itoa(n)), 0)
+	})
+}
+
+func Test_PersistenceReload(t *testing.T) {
+	for _, interval := range []time.Duration{0, time.Millisecond, time.Hour} {
+		dir := tempDir(t)
+		defer os.RemoveAll(dir)
+
+		b, err := NewPersistentMemoryBackend(dir, interval)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, r := range persisted {
+			if _, err := b.PushRange(r); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := b.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		b, err = NewPersistentMemoryBackend(dir, interval)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkPersisted(t, b)
+		b.Close()
+	}
+}
+
+func Test_PersistenceCrash(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	// Never snapshots and is never closed.
+	b, err := NewPersistentMemoryBackend(dir, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.PushRange(persisted[0]); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Batch([]Operation{
+		{Op: PushOperation, Range: persisted[1]},
+		{Op: PushOperation, Range: persisted[2]},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Simulate a crash while writing an operation.
+	journal, err := os.OpenFile(filepath.Join(dir, journalFile), os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	journal.WriteString(`{"sequence":3,"op":"push","range":{"upper":`)
+	journal.Close()
+
+	reloaded, err := NewPersistentMemoryBackend(dir, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkPersisted(t, reloaded)
+	reloaded.Close()
+}
+
+func Test_PersistenceSnapshotFailure(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	b, err := NewPersistentMemoryBackend(dir, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// What the periodic snapshots do.
+	m := b.(*memoryBackend)
+	tick := func() error {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		m.p.err = m.p.snapshot(m.storage())
+		return m.p.err
+	}
+
+	// The new journal cannot be written: the old one is still used.
+	obstacle := filepath.Join(dir, journalFile+".tmp")
+	if err := os.Mkdir(obstacle, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.PushRange(persisted[0]); err != nil {
+		t.Fatal(err)
+	}
+	if tick() == nil {
+		t.Fatal("the journal was written")
+	}
+	if _, err := b.Batch([]Operation{
+		{Op: PushOperation, Range: persisted[1]},
+		{Op: PushOperation, Range: persisted[2]},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	os.Remove(obstacle)
+
+	// The snapshot cannot be written: the next change fails.
+	obstacle = filepath.Join(dir, snapshotFile+".tmp")
+	if err := os.Mkdir(obstacle, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.PushRange(NumberRange{Lower: 300000000000000, Upper: 399999999999999}); err != nil {
+		t.Fatal(err)
+	}
+	if tick() == nil {
+		t.Fatal("the snapshot was written")
+	}
+	if _, err := b.PushRange(NumberRange{Lower: 400000000000000, Upper: 499999999999999}); err == nil {
+		t.Error("a change was taken after a failed snapshot")
+	}
+	os.Remove(obstacle)
+	if _, err := b.DeleteRange(300000000000000, 399999999999999); err != nil {
+		t.Fatal(err)
+	}
+
+	// Crash without closing.
+	reloaded, err := NewPersistentMemoryBackend(dir, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkPersisted(t, reloaded)
+	reloaded.Close()
+}
+
+func Test_PersistenceVersion(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	err := ioutil.WriteFile(filepath.Join(dir, snapshotFile), []byte(`{"version":999,"ranges":[]}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewPersistentMemoryBackend(dir, 0); err == nil {
+		t.Error("expected an error for an unsupported snapshot version")
+	}
+}
+
+func Test_PersistenceVersion1(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	// Version 1 wrote the bounds as numbers.
+	snapshot := `{"version":1,"sequence":1,"ranges":[{"upper":199999999999999,"lower":100000000000000,"records":[]}]}`
+	journal := `{"version":1}
+{"sequence":2,"op":"push","range":{"upper":299999999999999,"lower":200000000000000,"records":[]}}
+`
+	if err := ioutil.WriteFile(filepath.Join(dir, snapshotFile), []byte(snapshot), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, journalFile), []byte(journal), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := NewPersistentMemoryBackend(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	results, err := b.RangesBetween(0, math.MaxInt64, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 2 || results[0].Lower != 100000000000000 || results[1].Upper != 299999999999999 {
+		t.Errorf("RangesBetween returned %v", results)
+	}
+}
@@ -0,0 +1,417 @@
+// Copyright 2016 Hadrien Kohl hadrien.kohl@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package sql implements a Backend on top of database/sql.
+//
+// The queries only use ? placeholders and portable column types so that the
+// same backend can be used with MySQL in production and with an embedded
+// SQLite database for tests.
+package sql
+
+import (
+	"database/sql"
+	. "enum-dns/enum"
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+)
+
+var schema = []string{
+	`CREATE TABLE IF NOT EXISTS number_range (
+		lower_bound BIGINT NOT NULL PRIMARY KEY,
+		upper_bound BIGINT NOT NULL,
+		ttl         INT NULL,
+		UNIQUE (upper_bound)
+	)`,
+	`CREATE TABLE IF NOT EXISTS number_record (
+		range_lower       BIGINT NOT NULL,
+		position          INT NOT NULL,
+		naptr_order       INT NOT NULL,
+		naptr_preference  INT NOT NULL,
+		naptr_flags       VARCHAR(255) NOT NULL,
+		naptr_service     VARCHAR(255) NOT NULL,
+		naptr_regexp      VARCHAR(255) NOT NULL,
+		naptr_replacement VARCHAR(255) NOT NULL,
+		record_type       VARCHAR(16) NOT NULL DEFAULT '',
+		uri_priority      INT NOT NULL DEFAULT 0,
+		uri_weight        INT NOT NULL DEFAULT 0,
+		record_target     VARCHAR(1024) NOT NULL DEFAULT '',
+		txt_text          VARCHAR(4096) NOT NULL DEFAULT '',
+		PRIMARY KEY (range_lower, position)
+	)`,
+	`CREATE TABLE IF NOT EXISTS number_nameserver (
+		range_lower BIGINT NOT NULL,
+		position    INT NOT NULL,
+		name        VARCHAR(255) NOT NULL,
+		addresses   VARCHAR(1024) NOT NULL,
+		PRIMARY KEY (range_lower, position)
+	)`,
+	// Its only row is updated first by every change, which locks it until the
+	// change is committed.
+	`CREATE TABLE IF NOT EXISTS number_lock (
+		id      INT NOT NULL PRIMARY KEY,
+		changes BIGINT NOT NULL
+	)`,
+}
+
+// Columns added after the tables were first created, with their definition.
+// They are added to the existing tables that do not have them.
+var migrations = []struct {
+	table, column, definition string
+}{
+	{"number_range", "ttl", "INT NULL"},
+	{"number_record", "record_type", "VARCHAR(16) NOT NULL DEFAULT ''"},
+	{"number_record", "uri_priority", "INT NOT NULL DEFAULT 0"},
+	{"number_record", "uri_weight", "INT NOT NULL DEFAULT 0"},
+	{"number_record", "record_target", "VARCHAR(1024) NOT NULL DEFAULT ''"},
+	{"number_record", "txt_text", "VARCHAR(4096) NOT NULL DEFAULT ''"},
+}
+
+// queryer is implemented by both *sql.DB and *sql.Tx.
+type queryer interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// sqlBackend can be shared by several processes: each change starts by
+// updating the row of the number_lock table so that the changes of every
+// process happen one after the other. The other processes do not get the
+// events of the changes.
+type sqlBackend struct {
+	db *sql.DB
+
+	// Serializes the changes so that they are observed in the order the
+	// transactions are committed.
+	mu sync.Mutex
+	Notifier
+}
+
+// NewSqlBackend opens the database using the given driver and data source
+// name and creates the tables if they do not exist yet. The driver has to be
+// registered by the caller.
+func NewSqlBackend(driver, source string) (Backend, error) {
+	db, err := sql.Open(driver, source)
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range schema {
+		if _, err := db.Exec(s); err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+	if err := migrate(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if err := insertLock(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &sqlBackend{db: db}, nil
+}
+
+// Insert the row of the number_lock table if it is missing.
+func insertLock(db *sql.DB) error {
+	var n int
+	if err := db.QueryRow("SELECT COUNT(*) FROM number_lock").Scan(&n); err != nil || n > 0 {
+		return err
+	}
+	if _, err := db.Exec("INSERT INTO number_lock (id, changes) VALUES (0, 0)"); err != nil {
+		// Another process may have inserted it meanwhile.
+		if db.QueryRow("SELECT COUNT(*) FROM number_lock").Scan(&n) != nil || n == 0 {
+			return err
+		}
+	}
+	return nil
+}
+
+// Add the missing columns to the tables.
+func migrate(db *sql.DB) error {
+	for _, m := range migrations {
+		// Selecting the column is the portable way to check that it exists.
+		rows, err := db.Query("SELECT " + m.column + " FROM " + m.table + " LIMIT 1")
+		if err == nil {
+			rows.Close()
+			continue
+		}
+		if _, err := db.Exec("ALTER TABLE " + m.table + " ADD COLUMN " + m.column + " " + m.definition); err != nil {
+			return fmt.Errorf("could not add column %s to %s: %v", m.column, m.table, err)
+		}
+	}
+	return nil
+}
+
+func (b *sqlBackend) RangesBetween(l, u uint64, c int) ([]NumberRange, error) {
+	if c == 0 {
+		return make([]NumberRange, 0), nil
+	}
+	return selectRanges(b.db, l, u, c)
+}
+
+func (b *sqlBackend) PushRange(add NumberRange) ([]NumberRange, error) {
+	return b.Batch([]Operation{{Op: PushOperation, Range: add}})
+}
+
+func (b *sqlBackend) GetRange(l, u uint64) (*NumberRange, error) {
+	var r NumberRange
+	var ttl sql.NullInt64
+	err := b.db.QueryRow(`SELECT lower_bound, upper_bound, ttl FROM number_range
+		WHERE lower_bound = ? AND upper_bound = ?`, l, u).Scan(&r.Lower, &r.Upper, &ttl)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	r.Ttl = ttlOf(ttl)
+	if err := selectDetails(b.db, &r); err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+func (b *sqlBackend) DeleteRange(l, u uint64) ([]NumberRange, error) {
+	return b.Batch([]Operation{{Op: DeleteOperation, Range: NumberRange{Lower: l, Upper: u}}})
+}
+
+// All the changes go through Batch so that each of them happens in one
+// transaction.
+func (b *sqlBackend) Batch(ops []Operation) ([]NumberRange, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	tx, err := b.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	// Wait for the changes of the other processes before reading the ranges:
+	// the lock is taken by the first statement so that the transaction does
+	// not read anything older.
+	if _, err := tx.Exec("UPDATE number_lock SET changes = changes + 1 WHERE id = 0"); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	results := make([]NumberRange, 0)
+	events := make([]Event, 0)
+	for _, op := range ops {
+		overlaps, changes, err := apply(tx, op)
+		if err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+		results = append(results, overlaps...)
+		events = append(events, changes...)
+	}
+	if err := b.Commit(tx.Commit, events...); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// Apply the operation in the transaction and return the ranges that were
+// overlapping with it and the events of the change.
+func apply(tx *sql.Tx, op Operation) ([]NumberRange, []Event, error) {
+	r := op.Range
+	if err := r.Check(); err != nil {
+		return nil, nil, err
+	}
+
+	switch op.Op {
+	case PushOperation:
+		overlaps, err := replaceRange(tx, r, r)
+		return overlaps, Events(r, overlaps, r), err
+	case DeleteOperation:
+		overlaps, err := replaceRange(tx, r)
+		return overlaps, Events(r, overlaps), err
+	default:
+		return nil, nil, fmt.Errorf("unknown operation %q", op.Op)
+	}
+}
+
+func (b *sqlBackend) Close() error {
+	return b.db.Close()
+}
+
+// Remove everything that overlaps with r, put back what is left of the
+// overlapping ranges and insert the given ranges. The overlapping ranges are
+// returned as they were before the change.
+func replaceRange(tx *sql.Tx, r NumberRange, with ...NumberRange) ([]NumberRange, error) {
+	overlaps, err := selectRanges(tx, r.Lower, r.Upper, math.MaxInt32)
+	if err != nil {
+		return nil, err
+	}
+	for _, o := range overlaps {
+		if err := deleteRange(tx, o.Lower); err != nil {
+			return nil, err
+		}
+		for _, rest := range o.Subtract(r) {
+			if err := insertRange(tx, rest); err != nil {
+				return nil, err
+			}
+		}
+	}
+	for _, add := range with {
+		if err := insertRange(tx, add); err != nil {
+			return nil, err
+		}
+	}
+	return overlaps, nil
+}
+
+// Select at most |c| ranges overlapping with [l:u], in reverse order if c is
+// negative.
+func selectRanges(q queryer, l, u uint64, c int) ([]NumberRange, error) {
+	order := "ASC"
+	if c < 0 {
+		order, c = "DESC", -c
+	}
+	rows, err := q.Query(`SELECT lower_bound, upper_bound, ttl FROM number_range
+		WHERE upper_bound >= ? AND lower_bound <= ?
+		ORDER BY lower_bound `+order+` LIMIT ?`, l, u, c)
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]NumberRange, 0)
+	for rows.Next() {
+		var r NumberRange
+		var ttl sql.NullInt64
+		if err := rows.Scan(&r.Lower, &r.Upper, &ttl); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		r.Ttl = ttlOf(ttl)
+		results = append(results, r)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// The records are fetched once the ranges rows are closed since some
+	// drivers cannot run two queries at the same time on one connection.
+	for i := range results {
+		if err := selectDetails(q, &results[i]); err != nil {
+			return nil, err
+		}
+	}
+	return results, nil
+}
+
+// Fetch the records and the name servers of the range.
+func selectDetails(q queryer, r *NumberRange) error {
+	var err error
+	if r.Records, err = selectRecords(q, r.Lower); err != nil {
+		return err
+	}
+	r.NameServers, err = selectNameServers(q, r.Lower)
+	return err
+}
+
+func selectRecords(q queryer, lower uint64) ([]Record, error) {
+	rows, err := q.Query(`SELECT record_type, naptr_order, naptr_preference,
+		naptr_flags, naptr_service, naptr_regexp, naptr_replacement,
+		uri_priority, uri_weight, record_target, txt_text FROM number_record
+		WHERE range_lower = ? ORDER BY position`, lower)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	records := make([]Record, 0)
+	for rows.Next() {
+		var r Record
+		if err := rows.Scan(&r.Type, &r.Order, &r.Preference, &r.Flags,
+			&r.Service, &r.Regexp, &r.Replacement,
+			&r.Priority, &r.Weight, &r.Target, &r.Text); err != nil {
+			return nil, err
+		}
+		records = append(records, r)
+	}
+	return records, rows.Err()
+}
+
+// The addresses of the name servers are stored separated by spaces.
+func selectNameServers(q queryer, lower uint64) ([]NameServer, error) {
+	rows, err := q.Query(`SELECT name, addresses FROM number_nameserver
+		WHERE range_lower = ? ORDER BY position`, lower)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var nameServers []NameServer
+	for rows.Next() {
+		var ns NameServer
+		var addresses string
+		if err := rows.Scan(&ns.Name, &addresses); err != nil {
+			return nil, err
+		}
+		ns.Addresses = strings.Fields(addresses)
+		nameServers = append(nameServers, ns)
+	}
+	return nameServers, rows.Err()
+}
+
+// The TTL of a range read from the ttl column.
+func ttlOf(ttl sql.NullInt64) *uint32 {
+	if !ttl.Valid {
+		return nil
+	}
+	t := uint32(ttl.Int64)
+	return &t
+}
+
+func insertRange(tx *sql.Tx, r NumberRange) error {
+	var ttl sql.NullInt64
+	if r.Ttl != nil {
+		ttl = sql.NullInt64{Int64: int64(*r.Ttl), Valid: true}
+	}
+	if _, err := tx.Exec(`INSERT INTO number_range (lower_bound, upper_bound, ttl)
+		VALUES (?, ?, ?)`, r.Lower, r.Upper, ttl); err != nil {
+		return err
+	}
+	for i, record := range r.Records {
+		if _, err := tx.Exec(`INSERT INTO number_record (range_lower, position,
+			record_type, naptr_order, naptr_preference, naptr_flags,
+			naptr_service, naptr_regexp, naptr_replacement, uri_priority,
+			uri_weight, record_target, txt_text)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			r.Lower, i, record.Type, record.Order, record.Preference,
+			record.Flags, record.Service, record.Regexp, record.Replacement,
+			record.Priority, record.Weight, record.Target, record.Text); err != nil {
+			return err
+		}
+	}
+	for i, ns := range r.NameServers {
+		if _, err := tx.Exec(`INSERT INTO number_nameserver (range_lower, position,
+			name, addresses) VALUES (?, ?, ?, ?)`,
+			r.Lower, i, ns.Name, strings.Join(ns.Addresses, " ")); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func deleteRange(tx *sql.Tx, lower uint64) error {
+	if _, err := tx.Exec("DELETE FROM number_record WHERE range_lower = ?", lower); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM number_nameserver WHERE range_lower = ?", lower); err != nil {
+		return err
+	}
+	_, err := tx.Exec("DELETE FROM number_range WHERE lower_bound = ?", lower)
+	return err
+}
@@ -0,0 +1,354 @@
+// Copyright 2016 Hadrien Kohl hadrien.kohl@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sql
+
+import (
+	"database/sql"
+	. "enum-dns/enum"
+	"enum-dns/enum/backend/backendtest"
+	_ "github.com/mattn/go-sqlite3"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func newTestBackend(t *testing.T) (Backend, func()) {
+	dir, err := ioutil.TempDir("", "enum-sql")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := NewSqlBackend("sqlite3", filepath.Join(dir, "enum.db"))
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return b, func() {
+		b.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func Test_Conformance(t *testing.T) {
+	dir, err := ioutil.TempDir("", "enum-sql")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	n := 0
+	backendtest.TestBackend(t, func() (Backend, error) {
+		n++
+		return NewSqlBackend("sqlite3", filepath.Join(dir, strconv.Itoa(n)+".db"))
+	})
+}
+
+func checkRanges(t *testing.T, b Backend, exp []NumberRange) {
+	results, err := b.RangesBetween(100000000000000, 999999999999999, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != len(exp) {
+		t.Fatalf("RangesBetween returned %d ranges, expected %d: %v", len(results), len(exp), results)
+	}
+	for i := range results {
+		if !results[i].Equals(exp[i]) {
+			t.Errorf("RangesBetween returned [%d:%d] at %d, expected [%d:%d]",
+				results[i].Lower, results[i].Upper, i, exp[i].Lower, exp[i].Upper)
+		}
+	}
+}
+
+func Test_PushRange(t *testing.T) {
+
+	base := NumberRange{Lower: 400000000000000, Upper: 500000000000000}
+
+	tt := []struct {
+		push NumberRange
+		exp  []NumberRange
+	}{
+		// Replace
+		{NumberRange{Lower: 400000000000000, Upper: 500000000000000}, []NumberRange{
+			{Lower: 400000000000000, Upper: 500000000000000},
+		}},
+		// Split
+		{NumberRange{Lower: 450000000000000, Upper: 460000000000000}, []NumberRange{
+			{Lower: 400000000000000, Upper: 449999999999999},
+			{Lower: 450000000000000, Upper: 460000000000000},
+			{Lower: 460000000000001, Upper: 500000000000000},
+		}},
+		// Trim
+		{NumberRange{Lower: 300000000000000, Upper: 450000000000000}, []NumberRange{
+			{Lower: 300000000000000, Upper: 450000000000000},
+			{Lower: 450000000000001, Upper: 500000000000000},
+		}},
+		{NumberRange{Lower: 450000000000000, Upper: 600000000000000}, []NumberRange{
+			{Lower: 400000000000000, Upper: 449999999999999},
+			{Lower: 450000000000000, Upper: 600000000000000},
+		}},
+		// Delete
+		{NumberRange{Lower: 300000000000000, Upper: 600000000000000}, []NumberRange{
+			{Lower: 300000000000000, Upper: 600000000000000},
+		}},
+		// Outside
+		{NumberRange{Lower: 600000000000000, Upper: 700000000000000}, []NumberRange{
+			{Lower: 400000000000000, Upper: 500000000000000},
+			{Lower: 600000000000000, Upper: 700000000000000},
+		}},
+	}
+
+	for _, v := range tt {
+		b, done := newTestBackend(t)
+		if _, err := b.PushRange(base); err != nil {
+			t.Fatal(err)
+		}
+		overwritten, err := b.PushRange(v.push)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v.push.OverlapWith(base) != (len(overwritten) == 1) {
+			t.Errorf("PushRange([%d:%d]) returned %d overwritten ranges",
+				v.push.Lower, v.push.Upper, len(overwritten))
+		}
+		checkRanges(t, b, v.exp)
+		done()
+	}
+}
+
+func Test_RangesBetween(t *testing.T) {
+	b, done := newTestBackend(t)
+	defer done()
+
+	ranges := []NumberRange{
+		{Lower: 100000000000000, Upper: 199999999999999},
+		{Lower: 200000000000000, Upper: 299999999999999},
+		{Lower: 300000000000000, Upper: 399999999999999},
+	}
+	for _, r := range ranges {
+		if _, err := b.PushRange(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tt := []struct {
+		l, u uint64
+		c    int
+		exp  []uint64
+	}{
+		{150000000000000, 150000000000000, 1, []uint64{100000000000000}},
+		{150000000000000, 350000000000000, 10, []uint64{100000000000000, 200000000000000, 300000000000000}},
+		{150000000000000, 350000000000000, 2, []uint64{100000000000000, 200000000000000}},
+		{150000000000000, 350000000000000, -2, []uint64{300000000000000, 200000000000000}},
+		{150000000000000, 350000000000000, 0, []uint64{}},
+		{400000000000000, 500000000000000, 10, []uint64{}},
+	}
+
+	for _, v := range tt {
+		results, err := b.RangesBetween(v.l, v.u, v.c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(results) != len(v.exp) {
+			t.Errorf("RangesBetween(%d, %d, %d) returned %d ranges, expected %d",
+				v.l, v.u, v.c, len(results), len(v.exp))
+			continue
+		}
+		for i := range results {
+			if results[i].Lower != v.exp[i] {
+				t.Errorf("RangesBetween(%d, %d, %d) returned %d at %d, expected %d",
+					v.l, v.u, v.c, results[i].Lower, i, v.exp[i])
+			}
+		}
+	}
+}
+
+func Test_Records(t *testing.T) {
+	b, done := newTestBackend(t)
+	defer done()
+
+	records := []Record{
+		{Order: 10, Preference: 100, Flags: "u", Service: "E2U+sip",
+			Regexp: "!^(.*)$!sip:\\1@first!", Replacement: "."},
+		{Order: 20, Preference: 100, Flags: "u", Service: "E2U+sip",
+			Regexp: "!^(.*)$!sip:\\1@second!", Replacement: "."},
+	}
+	if _, err := b.PushRange(NumberRange{Lower: 400000000000000, Upper: 500000000000000, Records: records}); err != nil {
+		t.Fatal(err)
+	}
+	// Split the range, both ends should keep the records.
+	if _, err := b.PushRange(NumberRange{Lower: 450000000000000, Upper: 450000000000000}); err != nil {
+		t.Fatal(err)
+	}
+
+	results, err := b.RangesBetween(400000000000000, 500000000000000, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range []NumberRange{results[0], results[2]} {
+		if len(r.Records) != len(records) {
+			t.Fatalf("[%d:%d] has %d records, expected %d", r.Lower, r.Upper, len(r.Records), len(records))
+		}
+		for i := range records {
+			if r.Records[i] != records[i] {
+				t.Errorf("[%d:%d] has record %v at %d, expected %v", r.Lower, r.Upper, r.Records[i], i, records[i])
+			}
+		}
+	}
+	if len(results[1].Records) != 0 {
+		t.Errorf("[%d:%d] has %d records, expected none", results[1].Lower, results[1].Upper, len(results[1].Records))
+	}
+}
+
+func Test_DeleteAndGetRange(t *testing.T) {
+	b, done := newTestBackend(t)
+	defer done()
+
+	for _, r := range []NumberRange{
+		{Lower: 100000000000000, Upper: 199999999999999},
+		{Lower: 200000000000000, Upper: 299999999999999},
+		{Lower: 300000000000000, Upper: 399999999999999},
+	} {
+		if _, err := b.PushRange(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	deleted, err := b.DeleteRange(150000000000000, 300000000000000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deleted) != 3 {
+		t.Errorf("DeleteRange returned %d ranges, expected 3", len(deleted))
+	}
+	checkRanges(t, b, []NumberRange{
+		{Lower: 100000000000000, Upper: 149999999999999},
+		{Lower: 300000000000001, Upper: 399999999999999},
+	})
+
+	if r, err := b.GetRange(100000000000000, 149999999999999); err != nil || r == nil {
+		t.Errorf("GetRange(100000000000000, 149999999999999) returned %v, %v", r, err)
+	}
+	if r, err := b.GetRange(100000000000000, 199999999999999); err != nil || r != nil {
+		t.Errorf("GetRange(100000000000000, 199999999999999) returned %v, %v, expected nil", r, err)
+	}
+}
+
+func Test_Migration(t *testing.T) {
+	dir, err := ioutil.TempDir("", "enum-sql")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	source := filepath.Join(dir, "enum.db")
+
+	// The table as it was before the ttl column.
+	db, err := sql.Open("sqlite3", source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(`CREATE TABLE number_range (
+		lower_bound BIGINT NOT NULL PRIMARY KEY,
+		upper_bound BIGINT NOT NULL,
+		UNIQUE (upper_bound)
+	)`); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(`INSERT INTO number_range VALUES (400000000000000, 499999999999999)`); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	b, err := NewSqlBackend("sqlite3", source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	r, err := b.GetRange(400000000000000, 499999999999999)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r == nil || r.Ttl != nil {
+		t.Fatalf("GetRange returned %v after the migration", r)
+	}
+
+	ttl := uint32(60)
+	if _, err := b.PushRange(NumberRange{Lower: 450000000000000, Upper: 459999999999999, Ttl: &ttl}); err != nil {
+		t.Fatal(err)
+	}
+	if r, err = b.GetRange(450000000000000, 459999999999999); err != nil {
+		t.Fatal(err)
+	}
+	if r == nil || r.Ttl == nil || *r.Ttl != ttl {
+		t.Errorf("GetRange returned %v, expected a TTL of %d", r, ttl)
+	}
+
+	// Opening the migrated database again leaves it as it is.
+	b2, err := NewSqlBackend("sqlite3", source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b2.Close()
+}
+
+func Test_SharedDatabase(t *testing.T) {
+	dir, err := ioutil.TempDir("", "enum-sql")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	source := filepath.Join(dir, "enum.db")
+
+	// Two processes pushing overlapping ranges to the same database.
+	errs := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		b, err := NewSqlBackend("sqlite3", source)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer b.Close()
+		go func(i uint64) {
+			for j := uint64(0); j < 200; j++ {
+				lower := 400000000000000 + (j*7+i*3)%20*10
+				if _, err := b.PushRange(NumberRange{Lower: lower, Upper: lower + 14}); err != nil {
+					errs <- err
+					return
+				}
+			}
+			errs <- nil
+		}(uint64(i))
+	}
+	for i := 0; i < 2; i++ {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	b, err := NewSqlBackend("sqlite3", source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	ranges, err := b.RangesBetween(0, 999999999999999, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i < len(ranges); i++ {
+		if ranges[i].Lower <= ranges[i-1].Upper {
+			t.Errorf("[%d:%d] overlaps with [%d:%d]", ranges[i-1].Lower, ranges[i-1].Upper, ranges[i].Lower, ranges[i].Upper)
+		}
+	}
+}
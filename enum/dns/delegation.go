@@ -0,0 +1,144 @@
+// Copyright 2016 Hadrien Kohl hadrien.kohl@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dns
+
+import (
+	"enum-dns/enum"
+	"github.com/miekg/dns"
+	"net"
+	"strings"
+)
+
+// The name of the digits in the zone, the apex if there are none.
+func (h *ENUMHandler) digitsName(digits string) string {
+	if digits == "" {
+		return h.domain()
+	}
+	return strings.Join(strings.Split(enum.Reverse(digits), ""), ".") + "." + h.domain()
+}
+
+// The prefix of the delegated range the digits are at or below, false if
+// they are above its prefixes.
+func cutOf(digits string, r enum.NumberRange) (string, bool) {
+	prefixes, err := r.Prefixes()
+	if err != nil {
+		return "", false
+	}
+	for _, p := range prefixes {
+		if strings.HasPrefix(digits, p) {
+			return p, true
+		}
+	}
+	return "", false
+}
+
+// Find the range of the number of the digits and the delegated range whose
+// prefix is at or above the digits. Delegated ranges of every length are
+// looked for as their names are cut from the zone, the lengths without
+// numbers are skipped as in prefixRange. Each range is nil if there is none.
+func (h *ENUMHandler) lookup(digits string) (own, cut *enum.NumberRange, err error) {
+	var prefix string
+	lengths := enum.Lengths()
+	for i := 0; i < len(lengths); {
+		// The number of this length at, above or below the name of the digits.
+		number := digits
+		if length := lengths[i]; len(number) < length {
+			number += strings.Repeat("0", length-len(number))
+		} else {
+			number = number[:length]
+		}
+		key, err := enum.NumberToKey(number)
+		if err != nil {
+			return nil, nil, err
+		}
+		r, err := h.rangeFrom(key)
+		if err != nil || r == nil {
+			return own, cut, err
+		}
+		if r.Lower > key {
+			i = nextLength(lengths, i, r.Lower)
+			continue
+		}
+		if len(number) == len(digits) {
+			own = r
+		}
+		if len(r.NameServers) > 0 {
+			if p, ok := cutOf(digits, *r); ok && (cut == nil || len(p) < len(prefix)) {
+				cut, prefix = r, p
+			}
+		}
+		i++
+	}
+	return own, cut, nil
+}
+
+// The NS records of the delegated range at the prefix and the glue of its
+// name servers in the zone. The TTL is the one of the range or of the apex
+// records.
+func (h *ENUMHandler) delegation(prefix string, r enum.NumberRange) (ns, glue []dns.RR) {
+	ttl := h.zone().SOA(h.domain()).Hdr.Ttl
+	if r.Ttl != nil {
+		ttl = *r.Ttl
+	}
+	name := h.digitsName(prefix)
+	for _, server := range r.NameServers {
+		target := strings.ToLower(dns.Fqdn(server.Name))
+		ns = append(ns, &dns.NS{
+			Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeNS, Class: dns.ClassINET, Ttl: ttl},
+			Ns:  target,
+		})
+		if !dns.IsSubDomain(h.domain(), target) {
+			continue
+		}
+		for _, a := range server.Addresses {
+			ip := net.ParseIP(a)
+			if ip4 := ip.To4(); ip4 != nil {
+				glue = append(glue, &dns.A{
+					Hdr: dns.RR_Header{Name: target, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: ttl},
+					A:   ip4,
+				})
+			} else if ip != nil {
+				glue = append(glue, &dns.AAAA{
+					Hdr:  dns.RR_Header{Name: target, Rrtype: dns.TypeAAAA, Class: dns.ClassINET, Ttl: ttl},
+					AAAA: ip,
+				})
+			}
+		}
+	}
+	return ns, glue
+}
+
+// Refer the client to the name servers of the delegated range for the prefix
+// covering the digits. The DS records of the delegated name are asked to the
+// parent zone: there are none. It returns nil if the digits are above the
+// prefixes of the range.
+func (h *ENUMHandler) referral(request *dns.Msg, digits string, r enum.NumberRange) *dns.Msg {
+	prefix, ok := cutOf(digits, r)
+	if !ok {
+		return nil
+	}
+	answer := h.answerForRequest(request)
+	if prefix == digits && request.Question[0].Qtype == dns.TypeDS {
+		return h.negative(answer, dns.RcodeSuccess)
+	}
+	answer.Authoritative = false
+	answer.Ns, answer.Extra = h.delegation(prefix, r)
+	return answer
+}
+
+// Check whether the answer is a referral.
+func isReferral(answer *dns.Msg) bool {
+	return !answer.Authoritative && len(answer.Ns) > 0 && answer.Ns[0].Header().Rrtype == dns.TypeNS
+}
@@ -0,0 +1,146 @@
+// Copyright 2016 Hadrien Kohl hadrien.kohl@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dns
+
+import (
+	"enum-dns/enum"
+	"github.com/miekg/dns"
+	"strings"
+	"testing"
+)
+
+// The numbers 3316xxxxxx are delegated to an operator, one of its name servers
+// is in the zone.
+func delegatedRange(t *testing.T) enum.NumberRange {
+	return enum.NumberRange{
+		Lower: key(t, "3316000000"), Upper: key(t, "3316999999"),
+		NameServers: []enum.NameServer{
+			{Name: "ns1.operator.example."},
+			{Name: "ns.e164.arpa.", Addresses: []string{"192.0.2.1", "2001:db8::1"}},
+		},
+	}
+}
+
+func Test_Referral(t *testing.T) {
+	address, stop := startHandler(t,
+		rangeWithRecords(key(t, "3310000000"), key(t, "3315999999"), 1),
+		delegatedRange(t),
+		// Numbers of another length below the delegation.
+		rangeWithRecords(key(t, "331600000000000"), key(t, "331600000000009"), 1),
+	)
+	defer stop()
+
+	// The names below the delegation are referred whatever the length of
+	// their numbers, even if they have records.
+	for _, name := range []string{enumName("3316000005"), enumName("3316"), enumName("33160"),
+		enumName("33160000051"), enumName("331600000000005")} {
+		r := query(t, "udp", address, name)
+		if r.Rcode != dns.RcodeSuccess || r.Authoritative || len(r.Answer) != 0 {
+			t.Errorf("%s: the referral is %v", name, r)
+			continue
+		}
+		if len(r.Ns) != 2 || r.Ns[0].Header().Name != enumName("3316") {
+			t.Errorf("%s: the referral has the authority %v", name, r.Ns)
+		}
+		if len(r.Extra) != 2 || r.Extra[0].(*dns.A).Hdr.Name != "ns.e164.arpa." || r.Extra[1].Header().Rrtype != dns.TypeAAAA {
+			t.Errorf("%s: the referral has the glue %v", name, r.Extra)
+		}
+	}
+
+	// The names above the delegation and the other ranges are answered.
+	r := query(t, "udp", address, enumName("331"))
+	if r.Rcode != dns.RcodeSuccess || !r.Authoritative || len(r.Answer) != 0 || len(r.Ns) != 1 {
+		t.Errorf("the name above the delegation has the answer %v", r)
+	}
+	r = query(t, "udp", address, enumName("3315000005"))
+	if len(r.Answer) != 1 {
+		t.Errorf("the range next to the delegation has the answer %v", r)
+	}
+
+	// There is no DS record of the delegation.
+	m := new(dns.Msg)
+	m.SetQuestion(enumName("3316"), dns.TypeDS)
+	r, _, err := new(dns.Client).Exchange(m, address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Rcode != dns.RcodeSuccess || !r.Authoritative || len(r.Answer) != 0 || len(r.Ns) != 1 || r.Ns[0].Header().Rrtype != dns.TypeSOA {
+		t.Errorf("the DS answer is %v", r)
+	}
+}
+
+func Test_TransferDelegation(t *testing.T) {
+	address, stop := startCustomHandler(t, ENUMHandler{TransferACL: localhost()},
+		rangeWithRecords(key(t, "3310000000"), key(t, "3310000009"), 1),
+		delegatedRange(t),
+	)
+	defer stop()
+
+	records, err := transferZone(t, address)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var ns, glue []string
+	for _, rr := range records[1 : len(records)-1] {
+		switch rr := rr.(type) {
+		case *dns.NS:
+			if rr.Hdr.Name != "e164.arpa." {
+				ns = append(ns, rr.Hdr.Name+" "+rr.Ns)
+			}
+		case *dns.A:
+			glue = append(glue, rr.Hdr.Name+" "+rr.A.String())
+		case *dns.AAAA:
+			glue = append(glue, rr.Hdr.Name+" "+rr.AAAA.String())
+		}
+	}
+	expected := []string{enumName("3316") + " ns1.operator.example.", enumName("3316") + " ns.e164.arpa."}
+	if !equalStrings(ns, expected) {
+		t.Errorf("the transfer delegates %v, expected %v", ns, expected)
+	}
+	expected = []string{"ns.e164.arpa. 192.0.2.1", "ns.e164.arpa. 2001:db8::1"}
+	if !equalStrings(glue, expected) {
+		t.Errorf("the transfer has the glue %v, expected %v", glue, expected)
+	}
+	for _, owner := range naptrOwners(records) {
+		if strings.HasSuffix(owner, enumName("3316")) {
+			t.Errorf("the transfer has NAPTR records below the delegation: %v", owner)
+		}
+	}
+}
+
+func Test_DnssecReferral(t *testing.T) {
+	zsk := generateKey(t, 257)
+	address, stop := startCustomHandler(t, ENUMHandler{Signer: &Signer{ZSK: zsk}}, delegatedRange(t))
+	defer stop()
+	keys := map[uint16]*dns.DNSKEY{zsk.DNSKEY.KeyTag(): zsk.DNSKEY}
+
+	r := querySigned(t, address, enumName("3316000005"), dns.TypeNAPTR)
+	if len(r.Ns) != 4 || r.Ns[0].Header().Rrtype != dns.TypeNS || r.Ns[1].Header().Rrtype != dns.TypeNS {
+		t.Fatalf("the signed referral has the authority %v", r.Ns)
+	}
+	nsec := findNsec(r.Ns)
+	if nsec == nil || nsec.Hdr.Name != enumName("3316") || len(nsec.TypeBitMap) != 3 || nsec.TypeBitMap[0] != dns.TypeNS {
+		t.Fatalf("the NSEC record of the referral is %v", nsec)
+	}
+	verifySigned(t, r.Ns[2:], keys)
+
+	r = querySigned(t, address, enumName("3316"), dns.TypeDS)
+	nsec = findNsec(r.Ns)
+	if nsec == nil || len(nsec.TypeBitMap) != 3 || nsec.TypeBitMap[0] != dns.TypeNS {
+		t.Fatalf("the NSEC record of the DS answer is %v", nsec)
+	}
+	verifySigned(t, r.Ns, keys)
+}
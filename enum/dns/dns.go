@@ -16,15 +16,17 @@ package dns
 
 import (
 	"enum-dns/enum"
-	"errors"
 	"github.com/miekg/dns"
 	"log"
-	"regexp"
+	"math"
+	"net"
 	"strings"
 	"time"
 )
 
-var reg = regexp.MustCompile("^([0-9]|\\.[0-9])+")
+// Largest UDP payload advertised to EDNS0 clients by default. It avoids IP
+// fragmentation on most networks.
+const defaultUDPSize = 1232
 
 type ENUMHandler struct {
 	Backend *enum.Backend
@@ -32,37 +34,104 @@ type ENUMHandler struct {
 	Error   *log.Logger
 	Warning *log.Logger
 	Trace   *log.Logger
+
+	// Zone served by the handler, e164.arpa. if empty.
+	Domain string
+	// Records at the apex of the zone, defaults if nil.
+	Zone *Zone
+	// TTL of the records of the ranges without one.
+	Ttl uint32
+	// Networks of the clients allowed to transfer the zone. Transfers are
+	// refused if empty.
+	TransferACL []*net.IPNet
+	// Changes of the zone sent to the secondaries asking for an incremental
+	// transfer. They get the whole zone if nil.
+	Journal *Journal
+	// Addresses of the secondaries notified of the changes of the zone.
+	Secondaries []string
+	// Signs the answers to the clients asking for DNSSEC records. The zone is
+	// not signed if nil.
+	Signer *Signer
+	// Limits the responses and the queries of the clients, nothing if nil.
+	RateLimiter *RateLimiter
+	// Networks of the clients allowed to query the zone, every client if
+	// empty, and of the clients refused even if they are allowed.
+	Allow, Deny []*net.IPNet
+	// Views of the zone. The clients of none get the data of Backend.
+	Views []*View
+	// Networks of the resolvers whose EDNS Client Subnet option chooses the
+	// view. The option is ignored from the other clients.
+	ClientSubnetFrom []*net.IPNet
+
+	// Largest UDP payload advertised to EDNS0 clients, defaultUDPSize if zero.
+	UDPSize uint16
+
+	// View of the client, none if nil.
+	view *View
 }
 
 func (h ENUMHandler) ServeDNS(writer dns.ResponseWriter, request *dns.Msg) {
 
 	defer func(s time.Time) {
-		h.Trace.Printf("dns request for %v (%s) (%v) from client %s (%s)",
-			request.Question[0], "udp", time.Now().Sub(s), writer.RemoteAddr().String(),
+		h.Trace.Printf("dns request for %v (%v) from client %s (%s)",
+			request.Question, time.Now().Sub(s), writer.RemoteAddr().String(),
 			writer.RemoteAddr().Network())
 	}(time.Now())
 
-	if answer, err := h.createAnswer(request); err == nil {
-
-		if answer == nil {
-			h.Trace.Printf("no result found for %s", request.Question[0])
-			notfound := &dns.Msg{}
-			notfound.SetReply(request)
-			notfound.SetRcode(request, dns.RcodeSuccess)
-			writer.WriteMsg(notfound)
+	if h.RateLimiter != nil {
+		switch h.RateLimiter.check(writer.RemoteAddr()) {
+		case drop:
+			h.Trace.Printf("response to %s dropped", writer.RemoteAddr())
+			return
+		case slip:
+			reply := new(dns.Msg)
+			reply.SetReply(request)
+			reply.Truncated = true
+			h.write(writer, request, reply)
+			return
+		case refuse:
+			h.Trace.Printf("query of %s over quota", writer.RemoteAddr())
+			h.writeRcode(writer, request, dns.RcodeRefused)
 			return
 		}
+	}
 
-		if err := writer.WriteMsg(answer); err != nil {
-			h.Error.Printf("error sending answer: %v", err)
-		}
+	if !h.allowQuery(writer.RemoteAddr()) {
+		h.Trace.Printf("query of %s refused", writer.RemoteAddr())
+		h.writeRcode(writer, request, dns.RcodeRefused)
+		return
+	}
 
+	if rcode := h.checkEdns(request); rcode != dns.RcodeSuccess {
+		h.Trace.Printf("invalid EDNS0 in request: %s", dns.RcodeToString[rcode])
+		h.writeRcode(writer, request, rcode)
+		return
+	}
+
+	// The handler is a copy: the view only applies to this request.
+	if view := h.chooseView(writer.RemoteAddr(), request); view != nil {
+		h.Trace.Printf("view %s for client %s", view.Name, writer.RemoteAddr())
+		h.useView(view)
+	}
+
+	if len(request.Question) == 1 && (request.Question[0].Qtype == dns.TypeAXFR || request.Question[0].Qtype == dns.TypeIXFR) {
+		h.transfer(writer, request)
+		return
+	}
+
+	// The answer is made under the lock of the zone so that its records and
+	// its serial are the ones of the same data.
+	h.zone().mu.RLock()
+	answer, err := h.createAnswer(request)
+	if err == nil && h.Signer != nil && dnssecOK(request) {
+		err = h.sign(request, answer)
+	}
+	h.zone().mu.RUnlock()
+	if err == nil {
+		h.write(writer, request, answer)
 	} else {
 		h.Error.Printf("[ERR] Error getting the answer: %v", err)
-		error := &dns.Msg{}
-		error.SetReply(request)
-		error.SetRcode(request, dns.RcodeServerFailure)
-		writer.WriteMsg(error)
+		h.writeRcode(writer, request, dns.RcodeServerFailure)
 	}
 
 }
@@ -73,61 +142,320 @@ func (h *ENUMHandler) answerForRequest(message *dns.Msg) *dns.Msg {
 	answer.SetReply(message)
 	answer.Authoritative = true
 	answer.RecursionAvailable = false
+	answer.Compress = true
 	return answer
 }
 
-// Extract the E164 part of an ENUM query. Ex: 1.2.3.4.domain -> 4321.
-func extractE164FromName(name string) (number uint64, err error) {
-	numberprefix := strings.Join(reg.FindAllString(name, -1), "")
-	number, err = enum.ConvertEnumToInt(numberprefix)
-	number, err = enum.PrefixToE164(number)
-	return
+// Check the EDNS0 part of the request and return the rcode of the error to
+// reply with, or RcodeSuccess.
+func (h *ENUMHandler) checkEdns(request *dns.Msg) int {
+	opts := 0
+	for _, rr := range request.Extra {
+		if rr.Header().Rrtype == dns.TypeOPT {
+			opts++
+		}
+	}
+	switch {
+	case opts > 1:
+		return dns.RcodeFormatError
+	case opts == 1 && request.IsEdns0().Version() != 0:
+		return dns.RcodeBadVers
+	}
+	return dns.RcodeSuccess
+}
+
+// Largest UDP payload advertised to EDNS0 clients.
+func (h *ENUMHandler) serverUDPSize() uint16 {
+	if h.UDPSize == 0 {
+		return defaultUDPSize
+	}
+	return h.UDPSize
+}
+
+// Largest UDP payload both the client and the server accept.
+func (h *ENUMHandler) udpSize(request *dns.Msg) int {
+	opt := request.IsEdns0()
+	if opt == nil {
+		return dns.MinMsgSize
+	}
+	size := opt.UDPSize()
+	if server := h.serverUDPSize(); server < size {
+		size = server
+	}
+	if size < dns.MinMsgSize {
+		size = dns.MinMsgSize
+	}
+	return int(size)
+}
+
+// Reply with an empty message and the given rcode.
+func (h *ENUMHandler) writeRcode(writer dns.ResponseWriter, request *dns.Msg, rcode int) {
+	reply := new(dns.Msg)
+	reply.SetRcode(request, rcode)
+	h.write(writer, request, reply)
+}
+
+// Write the response to the client. An OPT record is added if the request had
+// one; it also carries the upper bits of extended rcodes, the DO bit of the
+// request and the EDNS Client Subnet option used to choose the view. The
+// answers may differ for any other address of the subnet. UDP responses that
+// do not fit in what the client accepts are truncated and the TC bit is then
+// set so that the client retries over TCP.
+func (h *ENUMHandler) write(writer dns.ResponseWriter, request, response *dns.Msg) {
+	if request.IsEdns0() != nil {
+		response.SetEdns0(h.serverUDPSize(), dnssecOK(request))
+		if subnet := h.clientSubnet(writer.RemoteAddr(), request); subnet != nil {
+			echo := *subnet
+			echo.SourceScope = subnet.SourceNetmask
+			opt := response.IsEdns0()
+			opt.Option = append(opt.Option, &echo)
+		}
+	}
+	if writer.RemoteAddr().Network() == "udp" {
+		response.Truncate(h.udpSize(request))
+	}
+	if err := writer.WriteMsg(response); err != nil {
+		h.Error.Printf("error sending answer: %v", err)
+	}
+}
+
+// Zone served by the handler, e164.arpa. if Domain is empty.
+func (h *ENUMHandler) domain() string {
+	if h.Domain == "" {
+		return "e164.arpa."
+	}
+	return strings.ToLower(dns.Fqdn(h.Domain))
+}
+
+// The apex records of the zone, the default ones if Zone is nil.
+func (h *ENUMHandler) zone() *Zone {
+	if h.Zone == nil {
+		return defaultZone
+	}
+	return h.Zone
+}
+
+// Extract the ENUM part of a name of the zone. Ex: 4.3.2.1.e164.arpa. ->
+// 4.3.2.1. It is empty for the apex.
+func (h *ENUMHandler) extractEnumFromName(name string) string {
+	labels := dns.SplitDomainName(name)
+	labels = labels[:len(labels)-dns.CountLabel(h.domain())]
+	return strings.Join(labels, ".")
+}
+
+// Find a range of longer numbers starting with the given digits. The names of
+// these digits exist in the zone even if there is no number of their length.
+// The lengths are looked at in the order of their keys and the first range
+// after the digits tells the next length with numbers, so there is at most one
+// query per length of the zone. It returns nil if there is none.
+func (h *ENUMHandler) prefixRange(digits string) (*enum.NumberRange, error) {
+	lengths := enum.Lengths()
+	for i := 0; i < len(lengths); {
+		if lengths[i] <= len(digits) {
+			i++
+			continue
+		}
+		first, last, err := enum.PrefixToKeys(digits, lengths[i])
+		if err != nil {
+			return nil, err
+		}
+		r, err := h.rangeFrom(first)
+		if err != nil || r == nil {
+			return nil, err
+		}
+		if r.Lower <= last {
+			return r, nil
+		}
+		i = nextLength(lengths, i, r.Lower)
+	}
+	return nil, nil
 }
 
-// Create a dns answer with
-func (h *ENUMHandler) createAnswer(request *dns.Msg) (answer *dns.Msg, err error) {
+// The first range with numbers at or after the key, nil if there is none.
+func (h *ENUMHandler) rangeFrom(key uint64) (*enum.NumberRange, error) {
+	h.Trace.Printf("backend.RangesBetween(%d, %d, 1)", key, uint64(math.MaxInt64))
+	ranges, err := (*h.Backend).RangesBetween(key, math.MaxInt64, 1)
+	if err != nil || len(ranges) == 0 {
+		return nil, err
+	}
+	return &ranges[0], nil
+}
+
+// The index of the length to look at after the one at i when the first range
+// after the keys looked at starts at the key. The lengths whose keys are in
+// between have no numbers.
+func nextLength(lengths []int, i int, key uint64) int {
+	if n := enum.KeyLength(key); n != lengths[i] {
+		for j := i + 1; j < len(lengths); j++ {
+			if lengths[j] == n {
+				return j
+			}
+		}
+	}
+	return i + 1
+}
+
+// Add the SOA record used for negative caching to the answer and set its
+// rcode. A NOERROR answer without records means that the name exists but has
+// no record of the asked type (NODATA).
+func (h *ENUMHandler) negative(answer *dns.Msg, rcode int) *dns.Msg {
+	answer.Rcode = rcode
+	answer.Ns = append(answer.Ns, h.zone().Negative(h.domain()))
+	return answer
+}
+
+// Create the answer to the request. Names that are not in the zone are
+// refused and names that are not made of single digit labels are malformed.
+// The other names of the zone exist if a range contains the number they stand
+// for or if they are the prefix of a number of a range. The names at or below
+// the prefixes of a delegated range, whatever the length of their numbers,
+// get a referral to its name servers.
+func (h *ENUMHandler) createAnswer(request *dns.Msg) (*dns.Msg, error) {
 
 	if len(request.Question) != 1 {
-		err = errors.New("Received more than one question")
-		return
+		answer := new(dns.Msg)
+		return answer.SetRcode(request, dns.RcodeFormatError), nil
 	}
 
 	question := request.Question[0]
-	if question.Qtype != dns.TypeNAPTR {
-		err = errors.New("Received an unsupported query type '" + dns.Type(question.Qtype).String() + "'")
-		return
+	name := strings.ToLower(dns.Fqdn(question.Name))
+	if !dns.IsSubDomain(h.domain(), name) {
+		answer := new(dns.Msg)
+		return answer.SetRcode(request, dns.RcodeRefused), nil
 	}
 
-	var number uint64
-	if number, err = extractE164FromName(question.Name); err != nil {
-		return
+	answer := h.answerForRequest(request)
+
+	enumName := h.extractEnumFromName(name)
+	if enumName == "" {
+		switch question.Qtype {
+		case dns.TypeSOA:
+			answer.Answer = append(answer.Answer, h.zone().SOA(h.domain()))
+		case dns.TypeNS:
+			answer.Answer = append(answer.Answer, h.zone().NS(h.domain())...)
+		case dns.TypeDNSKEY:
+			if h.Signer == nil {
+				return h.negative(answer, dns.RcodeSuccess), nil
+			}
+			answer.Answer = append(answer.Answer, h.Signer.DNSKEY(h.domain(), h.zone().SOA(h.domain()).Hdr.Ttl)...)
+		default:
+			return h.negative(answer, dns.RcodeSuccess), nil
+		}
+		return answer, nil
 	}
 
-	var numberrange enum.NumberRange
-	h.Trace.Printf("backend.RangesBetween(%d, %d, 1)", number, number)
-	ranges, err := (*h.Backend).RangesBetween(number, number, 1)
-	if err != nil || len(ranges) != 1 {
-		return
+	// There is no number that long.
+	if dns.CountLabel(enumName) > enum.MaxDigits {
+		return h.negative(answer, dns.RcodeNameError), nil
+	}
+
+	number, err := enum.ConvertEnumToInt(enumName)
+	if err != nil {
+		h.Trace.Printf("malformed name %s: %v", name, err)
+		answer = new(dns.Msg)
+		return answer.SetRcode(request, dns.RcodeFormatError), nil
+	}
+
+	digits, _ := enum.KeyToNumber(number)
+	own, cut, err := h.lookup(digits)
+	if err != nil {
+		return nil, err
+	}
+	if cut != nil {
+		return h.referral(request, digits, *cut), nil
+	}
+
+	if own == nil {
+		// The name still exists if it is the prefix of longer numbers.
+		r, err := h.prefixRange(digits)
+		if err != nil {
+			return nil, err
+		}
+		if r == nil {
+			return h.negative(answer, dns.RcodeNameError), nil
+		}
+		return h.negative(answer, dns.RcodeSuccess), nil
+	}
+
+	// A CNAME record answers every type, it is the only record of its range.
+	var records []dns.RR
+	for _, rr := range h.rrs(question.Name, *own) {
+		if t := rr.Header().Rrtype; t == question.Qtype || t == dns.TypeCNAME {
+			records = append(records, rr)
+		}
+	}
+	if len(records) == 0 {
+		return h.negative(answer, dns.RcodeSuccess), nil
 	}
-	numberrange = ranges[0]
 
-	answer = h.answerForRequest(request)
+	answer.Answer = append(answer.Answer, records...)
+	return answer, nil
 
-	// Create and populate the NAPTR answers.
-	for _, record := range numberrange.Records {
-		naptr := new(dns.NAPTR)
-		naptr.Hdr = dns.RR_Header{Name: question.Name, Rrtype: question.Qtype, Class: question.Qclass, Ttl: 0}
-		naptr.Regexp = record.Regexp
+}
 
-		naptr.Preference = record.Preference
-		naptr.Service = record.Service
-		naptr.Flags = record.Flags
-		naptr.Order = record.Order
-		naptr.Replacement = record.Replacement
+// Create the records of the range the client sees for the name.
+func (h *ENUMHandler) rrs(name string, r enum.NumberRange) []dns.RR {
+	ttl := h.Ttl
+	if r.Ttl != nil {
+		ttl = *r.Ttl
+	}
 
-		answer.Answer = append(answer.Answer, naptr)
+	visible := h.records(r)
+	records := make([]dns.RR, 0, len(visible))
+	for _, record := range visible {
+		hdr := dns.RR_Header{Name: name, Class: dns.ClassINET, Ttl: ttl}
+		switch record.RecordType() {
+		case enum.NAPTRRecord:
+			hdr.Rrtype = dns.TypeNAPTR
+			records = append(records, &dns.NAPTR{
+				Hdr:         hdr,
+				Order:       record.Order,
+				Preference:  record.Preference,
+				Flags:       record.Flags,
+				Service:     record.Service,
+				Regexp:      record.Regexp,
+				Replacement: record.Replacement,
+			})
+		case enum.URIRecord:
+			hdr.Rrtype = dns.TypeURI
+			records = append(records, &dns.URI{
+				Hdr:      hdr,
+				Priority: record.Priority,
+				Weight:   record.Weight,
+				Target:   record.Target,
+			})
+		case enum.TXTRecord:
+			hdr.Rrtype = dns.TypeTXT
+			records = append(records, &dns.TXT{Hdr: hdr, Txt: splitText(record.Text)})
+		case enum.CNAMERecord:
+			hdr.Rrtype = dns.TypeCNAME
+			records = append(records, &dns.CNAME{Hdr: hdr, Target: dns.Fqdn(record.Target)})
+		}
 	}
+	return records
+}
 
-	return
+// Split the text of a TXT record in strings of at most 255 bytes, without
+// cutting the escaped characters.
+func splitText(text string) []string {
+	var parts []string
+	start, n := 0, 0
+	for i := 0; i < len(text); i++ {
+		if n == 255 {
+			parts = append(parts, text[start:i])
+			start, n = i, 0
+		}
+		if text[i] == '\\' && i+1 < len(text) {
+			i++
+			if i+2 < len(text) && isDigit(text[i]) && isDigit(text[i+1]) && isDigit(text[i+2]) {
+				i += 2
+			}
+		}
+		n++
+	}
+	return append(parts, text[start:])
+}
 
+func isDigit(c byte) bool {
+	return '0' <= c && c <= '9'
 }
@@ -0,0 +1,459 @@
+// Copyright 2016 Hadrien Kohl hadrien.kohl@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dns
+
+import (
+	"enum-dns/enum"
+	"enum-dns/enum/backend/memory"
+	"fmt"
+	"github.com/miekg/dns"
+	"io/ioutil"
+	"log"
+	"net"
+	"strings"
+	"testing"
+)
+
+var discard = log.New(ioutil.Discard, "", 0)
+
+// Listen on the same random port with UDP and TCP. The port given for UDP
+// can be taken for TCP, another one is tried then.
+func listen(t *testing.T) (net.PacketConn, net.Listener) {
+	var err error
+	for i := 0; i < 10; i++ {
+		var pc net.PacketConn
+		if pc, err = net.ListenPacket("udp", "127.0.0.1:0"); err != nil {
+			break
+		}
+		var l net.Listener
+		if l, err = net.Listen("tcp", pc.LocalAddr().String()); err == nil {
+			return pc, l
+		}
+		pc.Close()
+	}
+	t.Fatal(err)
+	return nil, nil
+}
+
+// Start UDP and TCP servers listening on the same random port.
+func startServer(t *testing.T, h dns.Handler) (string, func()) {
+	pc, l := listen(t)
+
+	started := make(chan bool, 2)
+	notify := func() { started <- true }
+	servers := []*dns.Server{
+		{PacketConn: pc, Handler: h, NotifyStartedFunc: notify},
+		{Listener: l, Handler: h, NotifyStartedFunc: notify},
+	}
+	for _, server := range servers {
+		go server.ActivateAndServe()
+	}
+	<-started
+	<-started
+
+	return pc.LocalAddr().String(), func() {
+		for _, server := range servers {
+			server.Shutdown()
+		}
+	}
+}
+
+// Start a server for the e164.arpa. zone with the given ranges.
+func startHandler(t *testing.T, ranges ...enum.NumberRange) (string, func()) {
+	return startZoneHandler(t, nil, ranges...)
+}
+
+// Start a server for the e164.arpa. zone with the given apex and ranges.
+func startZoneHandler(t *testing.T, zone *Zone, ranges ...enum.NumberRange) (string, func()) {
+	return startCustomHandler(t, ENUMHandler{Zone: zone}, ranges...)
+}
+
+// Start a server for the e164.arpa. zone with the given handler. Its backend
+// is a memory backend with the ranges.
+func startCustomHandler(t *testing.T, h ENUMHandler, ranges ...enum.NumberRange) (string, func()) {
+	backend, err := memory.NewMemoryBackend()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range ranges {
+		if _, err := backend.PushRange(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	h.Backend = &backend
+	h.Info, h.Error, h.Warning, h.Trace = discard, discard, discard, discard
+
+	// The handler is registered for the root zone to check that it refuses
+	// the names that are not in its own.
+	mux := dns.NewServeMux()
+	mux.Handle(".", h)
+	return startServer(t, mux)
+}
+
+// Returns the ENUM name of the number.
+func enumName(number string) string {
+	return strings.Join(strings.Split(enum.Reverse(number), ""), ".") + ".e164.arpa."
+}
+
+// A range with n records.
+func rangeWithRecords(l, u uint64, n int) enum.NumberRange {
+	r := enum.NumberRange{Lower: l, Upper: u}
+	for i := 0; i < n; i++ {
+		r.Records = append(r.Records, enum.Record{
+			Order: uint16(i), Preference: 100, Flags: "u", Service: "E2U+sip",
+			Regexp: fmt.Sprintf("!^(.*)$!sip:\\\\1@gateway-%d.example.com!", i), Replacement: ".",
+		})
+	}
+	return r
+}
+
+// The key of a number.
+func key(t *testing.T, number string) uint64 {
+	k, err := enum.NumberToKey(number)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return k
+}
+
+func query(t *testing.T, network, address, name string) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetQuestion(name, dns.TypeNAPTR)
+	c := &dns.Client{Net: network}
+	r, _, err := c.Exchange(m, address)
+	if err != nil {
+		t.Fatalf("%s query for %s failed: %v", network, name, err)
+	}
+	return r
+}
+
+func Test_Truncation(t *testing.T) {
+	address, stop := startHandler(t,
+		rangeWithRecords(100000000000000, 199999999999999, 1),
+		rangeWithRecords(200000000000000, 299999999999999, 30),
+	)
+	defer stop()
+
+	tt := []struct {
+		network   string
+		number    string
+		truncated bool
+		answers   int
+	}{
+		{"udp", "100000000000005", false, 1},
+		{"tcp", "100000000000005", false, 1},
+		{"udp", "200000000000005", true, -1},
+		{"tcp", "200000000000005", false, 30},
+	}
+
+	for _, v := range tt {
+		r := query(t, v.network, address, enumName(v.number))
+		if r.Truncated != v.truncated {
+			t.Errorf("%s answer for %s has TC %t, expected %t", v.network, v.number, r.Truncated, v.truncated)
+		}
+		// The answer was compressed on the wire.
+		r.Compress = true
+		if r.Len() > dns.MinMsgSize && v.network == "udp" {
+			t.Errorf("%s answer for %s is %d bytes long", v.network, v.number, r.Len())
+		}
+		if v.answers >= 0 && len(r.Answer) != v.answers {
+			t.Errorf("%s answer for %s has %d records, expected %d", v.network, v.number, len(r.Answer), v.answers)
+		}
+		if v.answers < 0 && len(r.Answer) >= 30 {
+			t.Errorf("%s answer for %s has all the records", v.network, v.number)
+		}
+	}
+}
+
+func Test_Edns(t *testing.T) {
+	address, stop := startHandler(t,
+		rangeWithRecords(100000000000000, 199999999999999, 1),
+		rangeWithRecords(200000000000000, 299999999999999, 12),
+		rangeWithRecords(300000000000000, 399999999999999, 30),
+	)
+	defer stop()
+
+	tt := []struct {
+		name      string
+		number    string
+		opts      []uint8 // EDNS versions of the OPT records of the query.
+		size      uint16
+		rcode     int
+		truncated bool
+		answers   int
+	}{
+		{"no edns", "100000000000005", nil, 0, dns.RcodeSuccess, false, 1},
+		{"edns", "100000000000005", []uint8{0}, 4096, dns.RcodeSuccess, false, 1},
+		{"large answer without edns", "200000000000005", nil, 0, dns.RcodeSuccess, true, -1},
+		{"large answer with edns", "200000000000005", []uint8{0}, 4096, dns.RcodeSuccess, false, 12},
+		{"small advertised size", "200000000000005", []uint8{0}, 512, dns.RcodeSuccess, true, -1},
+		{"larger than the server size", "300000000000005", []uint8{0}, 4096, dns.RcodeSuccess, true, -1},
+		{"unsupported version", "100000000000005", []uint8{1}, 4096, dns.RcodeBadVers, false, 0},
+		{"two opt records", "100000000000005", []uint8{0, 0}, 4096, dns.RcodeFormatError, false, 0},
+	}
+
+	for _, v := range tt {
+		m := new(dns.Msg)
+		m.SetQuestion(enumName(v.number), dns.TypeNAPTR)
+		for _, version := range v.opts {
+			opt := &dns.OPT{Hdr: dns.RR_Header{Name: ".", Rrtype: dns.TypeOPT}}
+			opt.SetUDPSize(v.size)
+			opt.SetVersion(version)
+			m.Extra = append(m.Extra, opt)
+		}
+
+		c := &dns.Client{Net: "udp", UDPSize: 4096}
+		r, _, err := c.Exchange(m, address)
+		if err != nil {
+			t.Fatalf("%s: query failed: %v", v.name, err)
+		}
+
+		if r.Rcode != v.rcode {
+			t.Errorf("%s: rcode is %s, expected %s", v.name, dns.RcodeToString[r.Rcode], dns.RcodeToString[v.rcode])
+		}
+		if opt := r.IsEdns0(); (opt != nil) != (len(v.opts) > 0) {
+			t.Errorf("%s: answer has OPT %t, expected %t", v.name, opt != nil, len(v.opts) > 0)
+		} else if opt != nil && opt.Version() != 0 {
+			t.Errorf("%s: answer has EDNS version %d", v.name, opt.Version())
+		}
+		if r.Truncated != v.truncated {
+			t.Errorf("%s: answer has TC %t, expected %t", v.name, r.Truncated, v.truncated)
+		}
+		if v.answers >= 0 && len(r.Answer) != v.answers {
+			t.Errorf("%s: answer has %d records, expected %d", v.name, len(r.Answer), v.answers)
+		}
+		// The answer was compressed on the wire.
+		r.Compress = true
+		limit := dns.MinMsgSize
+		if len(v.opts) > 0 {
+			limit = int(v.size)
+			if limit > defaultUDPSize {
+				limit = defaultUDPSize
+			}
+		}
+		if r.Len() > limit {
+			t.Errorf("%s: answer is %d bytes long, limit is %d", v.name, r.Len(), limit)
+		}
+	}
+}
+
+func Test_NegativeAnswers(t *testing.T) {
+	address, stop := startHandler(t,
+		rangeWithRecords(100000000000000, 199999999999999, 1),
+		rangeWithRecords(470000000000000, 479999999999999, 1),
+		rangeWithRecords(500000000000000, 599999999999999, 0),
+		rangeWithRecords(key(t, "6230"), key(t, "6239"), 2),
+		rangeWithRecords(key(t, "1234567890123456"), key(t, "1234567890123456"), 3),
+	)
+	defer stop()
+
+	tt := []struct {
+		name    string
+		qtype   uint16
+		rcode   int
+		answers int
+		soa     bool // SOA in the authority section.
+	}{
+		{enumName("100000000000005"), dns.TypeNAPTR, dns.RcodeSuccess, 1, false},
+		{"5.0.0.0.0.0.0.0.0.0.0.0.0.0.1.E164.ARPA.", dns.TypeNAPTR, dns.RcodeSuccess, 1, false},
+		{enumName("100000000000005"), dns.TypeA, dns.RcodeSuccess, 0, true},
+		{enumName("200000000000005"), dns.TypeNAPTR, dns.RcodeNameError, 0, true},
+		{enumName("200000000000005"), dns.TypeA, dns.RcodeNameError, 0, true},
+		{enumName("500000000000005"), dns.TypeNAPTR, dns.RcodeSuccess, 0, true},
+		// 4 is not in a range but 47 is.
+		{enumName("4"), dns.TypeNAPTR, dns.RcodeSuccess, 0, true},
+		{enumName("3"), dns.TypeNAPTR, dns.RcodeNameError, 0, true},
+		{enumName("0"), dns.TypeNAPTR, dns.RcodeNameError, 0, true},
+		{enumName("1000000000000050"), dns.TypeNAPTR, dns.RcodeNameError, 0, true},
+		{"5.x.1.e164.arpa.", dns.TypeNAPTR, dns.RcodeFormatError, 0, false},
+		{"5.12.1.e164.arpa.", dns.TypeNAPTR, dns.RcodeFormatError, 0, false},
+		// Numbers only match the ranges of their length.
+		{enumName("6234"), dns.TypeNAPTR, dns.RcodeSuccess, 2, false},
+		{enumName("623400000000000"), dns.TypeNAPTR, dns.RcodeNameError, 0, true},
+		{enumName("0006234"), dns.TypeNAPTR, dns.RcodeNameError, 0, true},
+		{enumName("6299"), dns.TypeNAPTR, dns.RcodeNameError, 0, true},
+		{enumName("62"), dns.TypeNAPTR, dns.RcodeSuccess, 0, true},
+		{enumName("4712"), dns.TypeNAPTR, dns.RcodeSuccess, 0, true},
+		{enumName("1234567890123456"), dns.TypeNAPTR, dns.RcodeSuccess, 3, false},
+		{enumName("1234567890123456789"), dns.TypeNAPTR, dns.RcodeNameError, 0, true},
+		{"e164.arpa.", dns.TypeSOA, dns.RcodeSuccess, 1, false},
+		{"e164.arpa.", dns.TypeNAPTR, dns.RcodeSuccess, 0, true},
+		{"example.com.", dns.TypeNAPTR, dns.RcodeRefused, 0, false},
+	}
+
+	for _, v := range tt {
+		m := new(dns.Msg)
+		m.SetQuestion(v.name, v.qtype)
+		r, _, err := new(dns.Client).Exchange(m, address)
+		if err != nil {
+			t.Fatalf("query for %s failed: %v", v.name, err)
+		}
+
+		qtype := dns.TypeToString[v.qtype]
+		if r.Rcode != v.rcode {
+			t.Errorf("%s %s: rcode is %s, expected %s", v.name, qtype, dns.RcodeToString[r.Rcode], dns.RcodeToString[v.rcode])
+		}
+		if len(r.Answer) != v.answers {
+			t.Errorf("%s %s: answer has %d records, expected %d", v.name, qtype, len(r.Answer), v.answers)
+		}
+		soa := len(r.Ns) == 1 && r.Ns[0].Header().Rrtype == dns.TypeSOA && r.Ns[0].Header().Name == "e164.arpa."
+		if soa != v.soa {
+			t.Errorf("%s %s: authority section is %v", v.name, qtype, r.Ns)
+		}
+		if r.Authoritative != (v.rcode != dns.RcodeRefused && v.rcode != dns.RcodeFormatError) {
+			t.Errorf("%s %s: answer has AA %t", v.name, qtype, r.Authoritative)
+		}
+	}
+}
+
+// Counts the lookups made in the backend.
+type countingBackend struct {
+	enum.Backend
+	lookups int
+}
+
+func (b *countingBackend) RangesBetween(l, u uint64, c int) ([]enum.NumberRange, error) {
+	b.lookups++
+	return b.Backend.RangesBetween(l, u, c)
+}
+
+func Test_PrefixQueries(t *testing.T) {
+	backend, err := memory.NewMemoryBackend()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range []enum.NumberRange{
+		rangeWithRecords(key(t, "47000"), key(t, "47999"), 1),
+		rangeWithRecords(470000000000000, 479999999999999, 1),
+	} {
+		if _, err := backend.PushRange(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	counting := enum.Backend(&countingBackend{Backend: backend})
+	h := &ENUMHandler{Backend: &counting, Trace: discard}
+
+	// The lengths without numbers are not looked at: 48 is looked for in the
+	// 15 and 5 digits numbers only.
+	tt := []struct {
+		digits  string
+		found   bool
+		lookups int
+	}{
+		{"4", true, 1},
+		{"47123", true, 1},
+		{"48", false, 2},
+		{"4712345678901234", false, 1},
+	}
+	for _, v := range tt {
+		counting.(*countingBackend).lookups = 0
+		r, err := h.prefixRange(v.digits)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if lookups := counting.(*countingBackend).lookups; (r != nil) != v.found || lookups != v.lookups {
+			t.Errorf("%s: found %v with %d lookups, expected %t with %d", v.digits, r, lookups, v.found, v.lookups)
+		}
+	}
+}
+
+func Test_Ttl(t *testing.T) {
+	ttl := uint32(300)
+	withTtl := rangeWithRecords(200000000000000, 299999999999999, 2)
+	withTtl.Ttl = &ttl
+	zero := uint32(0)
+	withZeroTtl := rangeWithRecords(300000000000000, 399999999999999, 1)
+	withZeroTtl.Ttl = &zero
+
+	address, stop := startCustomHandler(t, ENUMHandler{Ttl: 60},
+		rangeWithRecords(100000000000000, 199999999999999, 1), withTtl, withZeroTtl)
+	defer stop()
+
+	tt := []struct {
+		number string
+		ttl    uint32
+	}{
+		{"100000000000005", 60},
+		{"200000000000005", 300},
+		{"300000000000005", 0},
+	}
+	for _, v := range tt {
+		r := query(t, "udp", address, enumName(v.number))
+		if len(r.Answer) == 0 {
+			t.Errorf("no answer for %s", v.number)
+		}
+		for _, rr := range r.Answer {
+			if rr.Header().Ttl != v.ttl {
+				t.Errorf("answer for %s has a TTL of %d, expected %d", v.number, rr.Header().Ttl, v.ttl)
+			}
+		}
+	}
+}
+
+func Test_RecordTypes(t *testing.T) {
+	typed := rangeWithRecords(200000000000000, 299999999999999, 1)
+	typed.Records = append(typed.Records,
+		enum.Record{Type: enum.URIRecord, Priority: 10, Weight: 1, Target: "sip:info@example.com"},
+		enum.Record{Type: enum.TXTRecord, Text: strings.Repeat("a", 254) + "\\\"b"},
+	)
+	alias := enum.NumberRange{Lower: 300000000000000, Upper: 399999999999999,
+		Records: []enum.Record{{Type: enum.CNAMERecord, Target: "5.0.0.0.0.0.0.0.0.0.0.0.0.0.2.e164.arpa"}}}
+
+	address, stop := startHandler(t, typed, alias)
+	defer stop()
+
+	tt := []struct {
+		number string
+		qtype  uint16
+		rrtype uint16
+		count  int
+	}{
+		{"200000000000005", dns.TypeNAPTR, dns.TypeNAPTR, 1},
+		{"200000000000005", dns.TypeURI, dns.TypeURI, 1},
+		{"200000000000005", dns.TypeTXT, dns.TypeTXT, 1},
+		{"200000000000005", dns.TypeA, 0, 0},
+		{"300000000000005", dns.TypeNAPTR, dns.TypeCNAME, 1},
+		{"300000000000005", dns.TypeCNAME, dns.TypeCNAME, 1},
+	}
+	for _, v := range tt {
+		m := new(dns.Msg)
+		m.SetQuestion(enumName(v.number), v.qtype)
+		r, _, err := new(dns.Client).Exchange(m, address)
+		if err != nil {
+			t.Fatal(err)
+		}
+		qtype := dns.TypeToString[v.qtype]
+		if r.Rcode != dns.RcodeSuccess || len(r.Answer) != v.count {
+			t.Errorf("%s %s: the answer is %v", v.number, qtype, r)
+			continue
+		}
+		if v.count > 0 && r.Answer[0].Header().Rrtype != v.rrtype {
+			t.Errorf("%s %s: the answer has the records %v", v.number, qtype, r.Answer)
+		}
+	}
+
+	// The long texts are split in strings of 255 bytes, the escaped quote
+	// is one of them.
+	m := new(dns.Msg)
+	m.SetQuestion(enumName("200000000000005"), dns.TypeTXT)
+	r, _, err := new(dns.Client).Exchange(m, address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if txt := r.Answer[0].(*dns.TXT).Txt; len(txt) != 2 || len(txt[0]) != 256 || txt[1] != "b" {
+		t.Errorf("the TXT record has the strings %q", txt)
+	}
+}
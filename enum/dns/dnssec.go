@@ -0,0 +1,254 @@
+// Copyright 2016 Hadrien Kohl hadrien.kohl@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dns
+
+import (
+	"crypto"
+	"enum-dns/enum"
+	"fmt"
+	"github.com/miekg/dns"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// How long the signatures are valid by default. They are made valid from an
+// hour before they are made, rounded to the hour, to cope with clock skews.
+// Their validity only changes once an hour but the signatures themselves
+// differ at every answer: ECDSA signatures are randomized.
+const defaultValidity = 7 * 24 * time.Hour
+
+// Key is a DNSSEC key with its private part.
+type Key struct {
+	DNSKEY  *dns.DNSKEY
+	Private crypto.Signer
+}
+
+// ReadKey reads a key written by dnssec-keygen: the DNSKEY record in path.key
+// and the private key in path.private.
+func ReadKey(path string) (*Key, error) {
+	public, err := os.Open(path + ".key")
+	if err != nil {
+		return nil, err
+	}
+	defer public.Close()
+	rr, err := dns.ReadRR(public, path+".key")
+	if err != nil {
+		return nil, err
+	}
+	dnskey, ok := rr.(*dns.DNSKEY)
+	if !ok {
+		return nil, fmt.Errorf("%s.key: not a DNSKEY record", path)
+	}
+
+	private, err := os.Open(path + ".private")
+	if err != nil {
+		return nil, err
+	}
+	defer private.Close()
+	key, err := dnskey.ReadPrivateKey(private, path+".private")
+	if err != nil {
+		return nil, err
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("%s.private: unsupported private key", path)
+	}
+	return &Key{DNSKEY: dnskey, Private: signer}, nil
+}
+
+// Signer signs the answers of a zone on the fly.
+type Signer struct {
+	// Key signing the DNSKEY records, the ZSK if nil.
+	KSK *Key
+	// Key signing the other records.
+	ZSK *Key
+	// How long the signatures are valid, defaultValidity if zero.
+	Validity time.Duration
+}
+
+func (s *Signer) ksk() *Key {
+	if s.KSK == nil {
+		return s.ZSK
+	}
+	return s.KSK
+}
+
+// DNSKEY returns the DNSKEY records of the zone for the domain.
+func (s *Signer) DNSKEY(domain string, ttl uint32) []dns.RR {
+	keys := []*Key{s.ksk()}
+	if s.KSK != nil {
+		keys = append(keys, s.ZSK)
+	}
+	var records []dns.RR
+	for _, k := range keys {
+		dnskey := *k.DNSKEY
+		dnskey.Hdr = dns.RR_Header{Name: domain, Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET, Ttl: ttl}
+		records = append(records, &dnskey)
+	}
+	return records
+}
+
+// Sign the RRset of the domain. The DNSKEY records are signed with the KSK
+// and the others with the ZSK.
+func (s *Signer) sign(rrset []dns.RR, domain string, now time.Time) (*dns.RRSIG, error) {
+	key := s.ZSK
+	if rrset[0].Header().Rrtype == dns.TypeDNSKEY {
+		key = s.ksk()
+	}
+	validity := s.Validity
+	if validity == 0 {
+		validity = defaultValidity
+	}
+	inception := now.Add(-time.Hour).Truncate(time.Hour)
+
+	rrsig := &dns.RRSIG{
+		Hdr:        dns.RR_Header{Ttl: rrset[0].Header().Ttl},
+		Algorithm:  key.DNSKEY.Algorithm,
+		KeyTag:     key.DNSKEY.KeyTag(),
+		SignerName: domain,
+		Inception:  uint32(inception.Unix()),
+		Expiration: uint32(inception.Add(validity).Unix()),
+	}
+	if err := rrsig.Sign(key.Private, rrset); err != nil {
+		return nil, err
+	}
+	return rrsig, nil
+}
+
+// Check whether the client asked for the DNSSEC records.
+func dnssecOK(request *dns.Msg) bool {
+	opt := request.IsEdns0()
+	return opt != nil && opt.Do()
+}
+
+// Sign the answer and prove that the name or the type asked does not exist in
+// negative answers. The denial of existence is compact (RFC 9824): the names
+// that do not exist are answered like names without records of the type, with
+// an NSEC record covering the name alone that lists the types of the name or
+// NXNAME. There is nothing to walk and a single signature to make.
+func (h *ENUMHandler) sign(request, answer *dns.Msg) error {
+	if answer.Rcode != dns.RcodeSuccess && answer.Rcode != dns.RcodeNameError {
+		return nil
+	}
+
+	now := time.Now()
+
+	// The name servers of a delegation are not signed, the NSEC record of
+	// the cut proves that it has no DS record.
+	if isReferral(answer) {
+		cut := answer.Ns[0].Header().Name
+		nsec, err := h.signRecords([]dns.RR{&dns.NSEC{
+			Hdr:        dns.RR_Header{Name: cut, Rrtype: dns.TypeNSEC, Class: dns.ClassINET, Ttl: h.zone().Negative(h.domain()).Hdr.Ttl},
+			NextDomain: "\\000." + cut,
+			TypeBitMap: []uint16{dns.TypeNS, dns.TypeRRSIG, dns.TypeNSEC},
+		}}, now)
+		answer.Ns = append(answer.Ns, nsec...)
+		return err
+	}
+
+	if len(answer.Answer) == 0 {
+		name := strings.ToLower(dns.Fqdn(request.Question[0].Name))
+		types := []uint16{dns.TypeNXNAME}
+		if answer.Rcode == dns.RcodeSuccess {
+			var err error
+			if types, err = h.types(name); err != nil {
+				return err
+			}
+		}
+		answer.Rcode = dns.RcodeSuccess
+
+		types = append(types, dns.TypeRRSIG, dns.TypeNSEC)
+		sort.Sort(byType(types))
+		answer.Ns = append(answer.Ns, &dns.NSEC{
+			Hdr:        dns.RR_Header{Name: name, Rrtype: dns.TypeNSEC, Class: dns.ClassINET, Ttl: h.zone().Negative(h.domain()).Hdr.Ttl},
+			NextDomain: "\\000." + name,
+			TypeBitMap: types,
+		})
+	}
+
+	var err error
+	if answer.Answer, err = h.signRecords(answer.Answer, now); err != nil {
+		return err
+	}
+	answer.Ns, err = h.signRecords(answer.Ns, now)
+	return err
+}
+
+// Add the signatures of the RRsets after them. The records of an RRset
+// follow each other.
+func (h *ENUMHandler) signRecords(records []dns.RR, now time.Time) ([]dns.RR, error) {
+	signed := make([]dns.RR, 0, 2*len(records))
+	for i := 0; i < len(records); {
+		end := i + 1
+		for end < len(records) && records[end].Header().Rrtype == records[i].Header().Rrtype &&
+			strings.EqualFold(records[end].Header().Name, records[i].Header().Name) {
+			end++
+		}
+		rrsig, err := h.Signer.sign(records[i:end], h.domain(), now)
+		if err != nil {
+			return nil, err
+		}
+		signed = append(signed, records[i:end]...)
+		signed = append(signed, rrsig)
+		i = end
+	}
+	return signed, nil
+}
+
+// The types of the records of a name that exists.
+func (h *ENUMHandler) types(name string) ([]uint16, error) {
+	if name == h.domain() {
+		return []uint16{dns.TypeSOA, dns.TypeNS, dns.TypeDNSKEY}, nil
+	}
+	number, err := enum.ConvertEnumToInt(h.extractEnumFromName(name))
+	if err != nil {
+		return nil, err
+	}
+	digits, _ := enum.KeyToNumber(number)
+	own, cut, err := h.lookup(digits)
+	if err != nil || own == nil && cut == nil {
+		return nil, err
+	}
+	if cut != nil {
+		return cutTypes(digits, *cut), nil
+	}
+	var types []uint16
+	seen := make(map[uint16]bool)
+	for _, rr := range h.rrs(name, *own) {
+		if t := rr.Header().Rrtype; !seen[t] {
+			seen[t] = true
+			types = append(types, t)
+		}
+	}
+	return types, nil
+}
+
+// The types of the digits in a delegated range: NS at the prefixes of the
+// range and nothing above them.
+func cutTypes(digits string, r enum.NumberRange) []uint16 {
+	if prefix, ok := cutOf(digits, r); ok && prefix == digits {
+		return []uint16{dns.TypeNS}
+	}
+	return nil
+}
+
+// Sorts the types in the order of the NSEC type bitmaps.
+type byType []uint16
+
+func (t byType) Len() int           { return len(t) }
+func (t byType) Swap(i, j int)      { t[i], t[j] = t[j], t[i] }
+func (t byType) Less(i, j int) bool { return t[i] < t[j] }
@@ -0,0 +1,235 @@
+// Copyright 2016 Hadrien Kohl hadrien.kohl@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dns
+
+import (
+	"crypto"
+	"github.com/miekg/dns"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Generate an ECDSA P-256 key of the e164.arpa. zone.
+func generateKey(t *testing.T, flags uint16) *Key {
+	dnskey := &dns.DNSKEY{
+		Hdr:       dns.RR_Header{Name: "e164.arpa.", Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET, Ttl: 3600},
+		Flags:     flags,
+		Protocol:  3,
+		Algorithm: dns.ECDSAP256SHA256,
+	}
+	private, err := dnskey.Generate(256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &Key{DNSKEY: dnskey, Private: private.(crypto.Signer)}
+}
+
+// Query the name with the DO bit set.
+func querySigned(t *testing.T, address, name string, qtype uint16) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetQuestion(name, qtype)
+	m.SetEdns0(4096, true)
+	r, _, err := (&dns.Client{Net: "tcp"}).Exchange(m, address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+// Verify that every RRset of the records is followed by its valid signature.
+func verifySigned(t *testing.T, records []dns.RR, keys map[uint16]*dns.DNSKEY) {
+	var rrset []dns.RR
+	for _, rr := range records {
+		rrsig, ok := rr.(*dns.RRSIG)
+		if !ok {
+			rrset = append(rrset, rr)
+			continue
+		}
+		if len(rrset) == 0 {
+			t.Errorf("signature of nothing: %v", rrsig)
+			continue
+		}
+		key := keys[rrsig.KeyTag]
+		if key == nil {
+			t.Errorf("unknown key %d", rrsig.KeyTag)
+		} else if err := rrsig.Verify(key, rrset); err != nil {
+			t.Errorf("invalid signature of %v: %v", rrset, err)
+		} else if !rrsig.ValidityPeriod(time.Now()) {
+			t.Errorf("signature not valid now: %v", rrsig)
+		}
+		rrset = nil
+	}
+	if len(rrset) > 0 {
+		t.Errorf("unsigned records: %v", rrset)
+	}
+}
+
+// Find the NSEC record of the records.
+func findNsec(records []dns.RR) *dns.NSEC {
+	for _, rr := range records {
+		if nsec, ok := rr.(*dns.NSEC); ok {
+			return nsec
+		}
+	}
+	return nil
+}
+
+func Test_Dnssec(t *testing.T) {
+	ksk, zsk := generateKey(t, 257), generateKey(t, 256)
+	address, stop := startCustomHandler(t, ENUMHandler{Signer: &Signer{KSK: ksk, ZSK: zsk}},
+		rangeWithRecords(100000000000000, 199999999999999, 2),
+	)
+	defer stop()
+
+	r := querySigned(t, address, "e164.arpa.", dns.TypeDNSKEY)
+	if len(r.Answer) != 3 {
+		t.Fatalf("DNSKEY answer is %v", r.Answer)
+	}
+	if opt := r.IsEdns0(); opt == nil || !opt.Do() {
+		t.Errorf("the DO bit is not set in the answer")
+	}
+	keys := make(map[uint16]*dns.DNSKEY)
+	for _, rr := range r.Answer[:2] {
+		dnskey := rr.(*dns.DNSKEY)
+		keys[dnskey.KeyTag()] = dnskey
+	}
+	if keys[ksk.DNSKEY.KeyTag()] == nil || keys[zsk.DNSKEY.KeyTag()] == nil {
+		t.Fatalf("DNSKEY answer is %v", r.Answer)
+	}
+	if r.Answer[2].(*dns.RRSIG).KeyTag != ksk.DNSKEY.KeyTag() {
+		t.Errorf("the DNSKEY records are not signed by the KSK: %v", r.Answer[2])
+	}
+	verifySigned(t, r.Answer, keys)
+
+	r = querySigned(t, address, enumName("100000000000005"), dns.TypeNAPTR)
+	if len(r.Answer) != 3 || r.Rcode != dns.RcodeSuccess {
+		t.Fatalf("NAPTR answer is %v", r)
+	}
+	verifySigned(t, r.Answer, keys)
+
+	r = querySigned(t, address, "e164.arpa.", dns.TypeSOA)
+	verifySigned(t, r.Answer, keys)
+
+	// Names that do not exist.
+	r = querySigned(t, address, enumName("200000000000005"), dns.TypeNAPTR)
+	if r.Rcode != dns.RcodeSuccess || len(r.Answer) != 0 {
+		t.Fatalf("the answer for a name that does not exist is %v", r)
+	}
+	nsec := findNsec(r.Ns)
+	if nsec == nil || nsec.Hdr.Name != enumName("200000000000005") || nsec.NextDomain != "\\000."+enumName("200000000000005") {
+		t.Fatalf("authority section is %v", r.Ns)
+	}
+	if len(nsec.TypeBitMap) != 3 || nsec.TypeBitMap[2] != dns.TypeNXNAME {
+		t.Errorf("the NSEC record does not say the name does not exist: %v", nsec)
+	}
+	verifySigned(t, r.Ns, keys)
+
+	// Types that do not exist.
+	r = querySigned(t, address, enumName("100000000000005"), dns.TypeTXT)
+	if nsec := findNsec(r.Ns); nsec == nil || len(nsec.TypeBitMap) != 3 || nsec.TypeBitMap[0] != dns.TypeNAPTR {
+		t.Errorf("authority section is %v", r.Ns)
+	}
+	verifySigned(t, r.Ns, keys)
+
+	r = querySigned(t, address, "e164.arpa.", dns.TypeNAPTR)
+	if nsec := findNsec(r.Ns); nsec == nil || len(nsec.TypeBitMap) != 5 {
+		t.Errorf("authority section is %v", r.Ns)
+	}
+	verifySigned(t, r.Ns, keys)
+
+	// Nothing is signed for the other clients.
+	r = query(t, "udp", address, enumName("200000000000005"))
+	if r.Rcode != dns.RcodeNameError || len(r.Ns) != 1 {
+		t.Errorf("the unsigned answer is %v", r)
+	}
+}
+
+func Test_DnssecSingleKey(t *testing.T) {
+	csk := generateKey(t, 257)
+	address, stop := startCustomHandler(t, ENUMHandler{Signer: &Signer{ZSK: csk}},
+		rangeWithRecords(100000000000000, 199999999999999, 1),
+	)
+	defer stop()
+
+	keys := map[uint16]*dns.DNSKEY{}
+	r := querySigned(t, address, "e164.arpa.", dns.TypeDNSKEY)
+	if len(r.Answer) != 2 {
+		t.Fatalf("DNSKEY answer is %v", r.Answer)
+	}
+	keys[csk.DNSKEY.KeyTag()] = r.Answer[0].(*dns.DNSKEY)
+	verifySigned(t, r.Answer, keys)
+
+	r = querySigned(t, address, enumName("100000000000005"), dns.TypeNAPTR)
+	verifySigned(t, r.Answer, keys)
+}
+
+func Test_DnssecUnsigned(t *testing.T) {
+	address, stop := startHandler(t)
+	defer stop()
+
+	r := querySigned(t, address, "e164.arpa.", dns.TypeDNSKEY)
+	if len(r.Answer) != 0 || len(r.Ns) != 1 {
+		t.Errorf("DNSKEY answer of an unsigned zone is %v", r)
+	}
+}
+
+func Test_ReadKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "enum-dns")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	dnskey := &dns.DNSKEY{
+		Hdr:       dns.RR_Header{Name: "e164.arpa.", Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET, Ttl: 3600},
+		Flags:     257,
+		Protocol:  3,
+		Algorithm: dns.ECDSAP256SHA256,
+	}
+	private, err := dnskey.Generate(256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "Ke164.arpa.+013+00001")
+	if err := ioutil.WriteFile(path+".key", []byte(dnskey.String()+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path+".private", []byte(dnskey.PrivateKeyString(private)), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := ReadKey(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key.DNSKEY.KeyTag() != dnskey.KeyTag() {
+		t.Errorf("read key %v, expected %v", key.DNSKEY, dnskey)
+	}
+
+	rrsig, err := (&Signer{ZSK: key}).sign([]dns.RR{dnskey}, "e164.arpa.", time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := rrsig.Verify(dnskey, []dns.RR{dnskey}); err != nil {
+		t.Errorf("invalid signature with the read key: %v", err)
+	}
+
+	if _, err := ReadKey(filepath.Join(dir, "missing")); err == nil {
+		t.Errorf("no error reading a missing key")
+	}
+}
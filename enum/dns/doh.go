@@ -0,0 +1,141 @@
+// Copyright 2016 Hadrien Kohl hadrien.kohl@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dns
+
+import (
+	"encoding/base64"
+	"github.com/miekg/dns"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+)
+
+// Media type of the DNS messages sent over HTTPS.
+const dohMediaType = "application/dns-message"
+
+// DoHHandler serves DNS over HTTPS (RFC 8484) with a DNS handler. The
+// requests are sent with GET, in the dns parameter encoded in base64url, or
+// with POST in the body. Zone transfers are refused.
+type DoHHandler struct {
+	Handler dns.Handler
+}
+
+// NewDoHHandler returns a DoHHandler serving with the DNS handler.
+func NewDoHHandler(h dns.Handler) *DoHHandler {
+	return &DoHHandler{Handler: h}
+}
+
+func (h *DoHHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var data []byte
+	var err error
+	switch r.Method {
+	case "GET":
+		data, err = base64.RawURLEncoding.DecodeString(r.URL.Query().Get("dns"))
+	case "POST":
+		if r.Header.Get("Content-Type") != dohMediaType {
+			http.Error(w, "unsupported content type", http.StatusUnsupportedMediaType)
+			return
+		}
+		data, err = ioutil.ReadAll(http.MaxBytesReader(w, r.Body, dns.MaxMsgSize))
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	request := new(dns.Msg)
+	if err == nil {
+		err = request.Unpack(data)
+	}
+	if err != nil || len(data) == 0 {
+		http.Error(w, "malformed DNS message", http.StatusBadRequest)
+		return
+	}
+
+	writer := &dohWriter{remote: remoteAddr(r)}
+	if len(request.Question) == 1 && (request.Question[0].Qtype == dns.TypeAXFR || request.Question[0].Qtype == dns.TypeIXFR) {
+		writer.WriteMsg(new(dns.Msg).SetRcode(request, dns.RcodeRefused))
+	} else {
+		h.Handler.ServeDNS(writer, request)
+	}
+	if writer.response == nil {
+		http.Error(w, "no answer", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", dohMediaType)
+	w.Header().Set("Cache-Control", "max-age="+strconv.FormatUint(uint64(minTtl(writer.response)), 10))
+	w.Write(writer.response)
+}
+
+// The smallest TTL of the records of the message, 0 if it has none.
+func minTtl(data []byte) uint32 {
+	m := new(dns.Msg)
+	if err := m.Unpack(data); err != nil {
+		return 0
+	}
+	var ttl uint32
+	first := true
+	for _, section := range [][]dns.RR{m.Answer, m.Ns, m.Extra} {
+		for _, rr := range section {
+			if rr.Header().Rrtype == dns.TypeOPT {
+				continue
+			}
+			if first || rr.Header().Ttl < ttl {
+				ttl, first = rr.Header().Ttl, false
+			}
+		}
+	}
+	return ttl
+}
+
+// The address of the HTTP client. It is a TCP address so that the answers
+// are never truncated.
+func remoteAddr(r *http.Request) net.Addr {
+	host, port, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return &net.TCPAddr{}
+	}
+	p, _ := strconv.Atoi(port)
+	return &net.TCPAddr{IP: net.ParseIP(host), Port: p}
+}
+
+// Keeps the answer of a DNS handler for the HTTP response.
+type dohWriter struct {
+	remote   net.Addr
+	response []byte
+}
+
+func (w *dohWriter) LocalAddr() net.Addr  { return &net.TCPAddr{} }
+func (w *dohWriter) RemoteAddr() net.Addr { return w.remote }
+
+func (w *dohWriter) WriteMsg(m *dns.Msg) error {
+	data, err := m.Pack()
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+func (w *dohWriter) Write(data []byte) (int, error) {
+	w.response = data
+	return len(data), nil
+}
+
+func (w *dohWriter) Close() error        { return nil }
+func (w *dohWriter) TsigStatus() error   { return nil }
+func (w *dohWriter) TsigTimersOnly(bool) {}
+func (w *dohWriter) Hijack()             {}
@@ -0,0 +1,179 @@
+// Copyright 2016 Hadrien Kohl hadrien.kohl@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dns
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"enum-dns/enum"
+	"github.com/miekg/dns"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// Create a self-signed certificate for 127.0.0.1 and a pool trusting it.
+func selfSigned(t *testing.T) (tls.Certificate, *x509.CertPool) {
+	private, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "enum-dns test"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &private.PublicKey, private)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certificate, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(certificate)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: private}, pool
+}
+
+// A handler of the ranges registered for the e164.arpa. zone.
+func enumMux(t *testing.T, ranges ...enum.NumberRange) dns.Handler {
+	h, _ := followedHandler(t, ENUMHandler{}, ranges...)
+	mux := dns.NewServeMux()
+	mux.Handle("e164.arpa.", *h)
+	return mux
+}
+
+func Test_DoT(t *testing.T) {
+	certificate, pool := selfSigned(t)
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{certificate}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	started := make(chan bool)
+	server := &dns.Server{
+		Listener:          l,
+		Net:               "tcp-tls",
+		Handler:           enumMux(t, rangeWithRecords(100000000000000, 199999999999999, 1)),
+		NotifyStartedFunc: func() { close(started) },
+	}
+	go server.ActivateAndServe()
+	defer server.Shutdown()
+	<-started
+
+	m := new(dns.Msg)
+	m.SetQuestion(enumName("100000000000005"), dns.TypeNAPTR)
+	client := &dns.Client{Net: "tcp-tls", TLSConfig: &tls.Config{RootCAs: pool}}
+	r, _, err := client.Exchange(m, l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Answer) != 1 {
+		t.Errorf("DoT answer is %v", r)
+	}
+}
+
+func Test_DoH(t *testing.T) {
+	certificate, pool := selfSigned(t)
+	server := httptest.NewUnstartedServer(NewDoHHandler(enumMux(t, rangeWithRecords(100000000000000, 199999999999999, 1))))
+	server.TLS = &tls.Config{Certificates: []tls.Certificate{certificate}}
+	server.Config.ErrorLog = discard
+	server.StartTLS()
+	defer server.Close()
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}}
+
+	pack := func(name string, qtype uint16) []byte {
+		m := new(dns.Msg)
+		m.SetQuestion(name, qtype)
+		m.Id = 0
+		data, err := m.Pack()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+	// Return the status, the answer and the cache control of the response.
+	read := func(response *http.Response, err error) (int, *dns.Msg, string) {
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer response.Body.Close()
+		if response.StatusCode != http.StatusOK {
+			return response.StatusCode, nil, ""
+		}
+		if ct := response.Header.Get("Content-Type"); ct != "application/dns-message" {
+			t.Errorf("content type is %s", ct)
+		}
+		data, err := ioutil.ReadAll(response.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m := new(dns.Msg)
+		if err := m.Unpack(data); err != nil {
+			t.Fatal(err)
+		}
+		return response.StatusCode, m, response.Header.Get("Cache-Control")
+	}
+	url := server.URL + "/dns-query"
+
+	query := base64.RawURLEncoding.EncodeToString(pack(enumName("100000000000005"), dns.TypeNAPTR))
+	_, m, cache := read(client.Get(url + "?dns=" + query))
+	if m == nil || len(m.Answer) != 1 {
+		t.Errorf("GET answer is %v", m)
+	}
+	if cache != "max-age=0" {
+		t.Errorf("cache control is %q", cache)
+	}
+
+	_, m, cache = read(client.Post(url, "application/dns-message", bytes.NewReader(pack(enumName("200000000000005"), dns.TypeNAPTR))))
+	if m == nil || m.Rcode != dns.RcodeNameError {
+		t.Errorf("POST answer is %v", m)
+	}
+	if cache != "max-age=60" {
+		t.Errorf("cache control of the negative answer is %q", cache)
+	}
+
+	_, m, _ = read(client.Post(url, "application/dns-message", bytes.NewReader(pack("e164.arpa.", dns.TypeAXFR))))
+	if m == nil || m.Rcode != dns.RcodeRefused {
+		t.Errorf("AXFR answer is %v", m)
+	}
+
+	if status, _, _ := read(client.Get(url + "?dns=invalid")); status != http.StatusBadRequest {
+		t.Errorf("status of a malformed GET is %d", status)
+	}
+	if status, _, _ := read(client.Post(url, "text/plain", bytes.NewReader(pack("e164.arpa.", dns.TypeSOA)))); status != http.StatusUnsupportedMediaType {
+		t.Errorf("status of a POST of text is %d", status)
+	}
+	request, _ := http.NewRequest("PUT", url, nil)
+	if status, _, _ := read(client.Do(request)); status != http.StatusMethodNotAllowed {
+		t.Errorf("status of a PUT is %d", status)
+	}
+}
@@ -0,0 +1,330 @@
+// Copyright 2016 Hadrien Kohl hadrien.kohl@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dns
+
+import (
+	"enum-dns/enum"
+	"github.com/miekg/dns"
+	"sync"
+	"time"
+)
+
+// How long to wait for the secondaries to acknowledge a NOTIFY, and how many
+// times to send it.
+const (
+	notifyTimeout  = 2 * time.Second
+	notifyAttempts = 3
+)
+
+// Journal keeps the last changes of the records of a zone by SOA serial so
+// that the secondaries can transfer them incrementally (IXFR). It is updated
+// by ENUMHandler.Follow and only used under the lock of the zone.
+type Journal struct {
+	// Largest number of changes kept.
+	size int
+	// Whether the journal knows the changes up to serial.
+	started bool
+	serial  uint32
+	// The changes, the oldest first.
+	changes []change
+	// Number of the delegated ranges at each prefix of the zone, nil if they
+	// are not known. The names of the numbers at or below these prefixes are
+	// not in the zone.
+	cuts map[string]int
+}
+
+// A change of the records of the zone from a serial to the next.
+type change struct {
+	from, to       uint32
+	deleted, added []dns.RR
+}
+
+// NewJournal returns a journal keeping the given number of changes.
+func NewJournal(size int) *Journal {
+	return &Journal{size: size}
+}
+
+// Start the journal at the serial, without changes.
+func (j *Journal) start(serial uint32) {
+	j.started, j.serial, j.changes = true, serial, nil
+}
+
+// Keep the change, which goes from the last serial.
+func (j *Journal) add(c change) {
+	j.changes = append(j.changes, c)
+	if len(j.changes) > j.size {
+		j.changes = j.changes[len(j.changes)-j.size:]
+	}
+	j.serial = c.to
+}
+
+// Return the changes from the serial to the last one and the last serial. It
+// returns false if the journal does not know what changed since the serial.
+func (j *Journal) since(serial uint32) ([]change, uint32, bool) {
+	if !j.started {
+		return nil, 0, false
+	}
+	if serial == j.serial {
+		return nil, j.serial, true
+	}
+	for i, c := range j.changes {
+		if c.from == serial {
+			return j.changes[i:], j.serial, true
+		}
+	}
+	return nil, 0, false
+}
+
+// Follow observes the backend and the ones of the views until the returned
+// function is called. Every change of the data bumps the serial of the zone
+// while it is committed, is kept by the journal of the handler if it has one
+// and is notified to the secondaries. The changes made by a batch are one
+// change. A backend that does not implement enum.Observer never changes the
+// serial.
+func (h *ENUMHandler) Follow() func() {
+	z := h.zone()
+	layers := len(h.layers())
+	var stops []func()
+	for i, b := range h.followed() {
+		view := i >= layers
+		stops = append(stops, enum.Observe(b, &z.mu, func(events []enum.Event) {
+			h.changed(events, view)
+		}))
+	}
+	if h.Journal != nil {
+		z.mu.Lock()
+		if !h.Journal.started {
+			h.startJournal()
+		}
+		z.mu.Unlock()
+	}
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			for _, stop := range stops {
+				stop()
+			}
+		})
+	}
+}
+
+// The backends whose changes change the serial: the layers of the zone, then
+// the other backends of the views.
+func (h *ENUMHandler) followed() []enum.Backend {
+	backends := h.layers()
+	seen := map[enum.Backend]bool{*h.Backend: true}
+	for _, b := range backends {
+		seen[b] = true
+	}
+	for _, v := range h.Views {
+		if v.Backend != nil && !seen[v.Backend] {
+			seen[v.Backend] = true
+			backends = append(backends, v.Backend)
+		}
+	}
+	return backends
+}
+
+// Bump the serial of the zone for the change of a followed backend, keep the
+// change in the journal and notify the secondaries. It is called under the
+// lock of the zone while the backend commits the change. The changes of the
+// views change no record of the zone: their secondaries always transfer the
+// whole zone. The journal starts again if the change is not known.
+func (h *ENUMHandler) changed(events []enum.Event, view bool) {
+	from, to := h.zone().Serial(), h.zone().Bump()
+	switch j := h.Journal; {
+	case j == nil:
+	case !j.started:
+		h.startJournal()
+	case view:
+		j.add(change{from: from, to: to})
+	default:
+		if c, ok := h.change(events); ok {
+			c.from, c.to = from, to
+			j.add(*c)
+		} else {
+			h.startJournal()
+		}
+	}
+	h.notify()
+}
+
+// Start the journal at the current serial of the zone. It is called under the
+// lock of the zone. The prefixes of the delegations are read if they are not
+// known, and the journal does not start if they cannot be.
+func (h *ENUMHandler) startJournal() {
+	j := h.Journal
+	if j.cuts == nil && len(h.layers()) == 1 {
+		j.started = false
+		ranges, err := allRanges(*h.Backend)
+		if err != nil {
+			h.Error.Printf("[ERR] Error getting the ranges of the zone: %v", err)
+			return
+		}
+		j.cuts = make(map[string]int)
+		for _, r := range ranges {
+			if !h.countCuts(r, 1) {
+				j.cuts = nil
+				return
+			}
+		}
+	}
+	j.start(h.zone().Serial())
+}
+
+// Add n to the number of delegated ranges at the prefixes of the range if it
+// is delegated. It returns false if its prefixes cannot be known.
+func (h *ENUMHandler) countCuts(r enum.NumberRange, n int) bool {
+	if len(r.NameServers) == 0 {
+		return true
+	}
+	prefixes, err := r.Prefixes()
+	if err != nil {
+		h.Error.Printf("[ERR] Error getting the prefixes of a delegation: %v", err)
+		return false
+	}
+	for _, p := range prefixes {
+		if h.Journal.cuts[p] += n; h.Journal.cuts[p] == 0 {
+			delete(h.Journal.cuts, p)
+		}
+	}
+	return true
+}
+
+// Returns the change of the records of the zone made by the events of a
+// change, false if the events do not tell it.
+//
+// The records of the ranges the events removed are deleted and the records
+// of the ranges they added are added, those deleted and added again being
+// left out. The events of a layered backend do not tell the base ranges the
+// overrides hide or reveal, nor do the events of a delegation tell the names
+// its prefixes hide or reveal: the journal starts again after them.
+func (h *ENUMHandler) change(events []enum.Event) (*change, bool) {
+	j := h.Journal
+	if j.cuts == nil {
+		return nil, false
+	}
+	type count struct {
+		rr dns.RR
+		n  int
+	}
+	counts := make(map[string]*count)
+	var order []string
+	ok := true
+	var names uint64
+	update := func(r enum.NumberRange, n int) {
+		if j.cuts != nil && !h.countCuts(r, n) {
+			j.cuts = nil
+		}
+		if len(r.NameServers) > 0 {
+			ok = false
+		}
+		if !ok || j.cuts == nil || len(h.records(r)) == 0 {
+			return
+		}
+		if names += r.Upper - r.Lower + 1; names > maxTransferNames {
+			ok = false
+			return
+		}
+		for key := r.Lower; key <= r.Upper; key++ {
+			digits, err := enum.KeyToNumber(key)
+			if err != nil {
+				h.Error.Printf("[ERR] Error getting the number of a change: %v", err)
+				ok = false
+				return
+			}
+			if delegated(j.cuts, digits) {
+				continue
+			}
+			for _, rr := range h.rrs(h.digitsName(digits), r) {
+				k := rr.String()
+				if counts[k] == nil {
+					counts[k] = &count{rr: rr}
+					order = append(order, k)
+				}
+				counts[k].n += n
+			}
+		}
+	}
+
+	var removed *enum.NumberRange
+	for _, e := range events {
+		// The trimmed events of a split range remove it once.
+		if e.Before != nil && !(e.Type == enum.TrimmedEvent && removed != nil && e.Before.Lower == removed.Lower && e.Before.Upper == removed.Upper) {
+			update(*e.Before, -1)
+		}
+		removed = e.Before
+		if e.After != nil {
+			update(*e.After, 1)
+		}
+	}
+	if !ok || j.cuts == nil {
+		return nil, false
+	}
+
+	c := &change{}
+	for _, k := range order {
+		switch counts[k].n {
+		case -1:
+			c.deleted = append(c.deleted, counts[k].rr)
+		case 0:
+		case 1:
+			c.added = append(c.added, counts[k].rr)
+		default:
+			h.Error.Printf("[ERR] The events of a change add or delete the record %s more than once", k)
+			return nil, false
+		}
+	}
+	return c, true
+}
+
+// Check whether the digits are at or below a prefix of the cuts.
+func delegated(cuts map[string]int, digits string) bool {
+	for i := 1; i <= len(digits); i++ {
+		if cuts[digits[:i]] > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Send a NOTIFY with the SOA record to the secondaries, in the background.
+func (h *ENUMHandler) notify() {
+	if len(h.Secondaries) == 0 {
+		return
+	}
+	m := new(dns.Msg)
+	m.SetNotify(h.domain())
+	m.Answer = []dns.RR{h.zone().SOA(h.domain())}
+	for _, address := range h.Secondaries {
+		go h.sendNotify(address, m.Copy())
+	}
+}
+
+// Send the NOTIFY until the secondary acknowledges it.
+func (h *ENUMHandler) sendNotify(address string, m *dns.Msg) {
+	client := &dns.Client{Timeout: notifyTimeout}
+	var err error
+	for i := 0; i < notifyAttempts; i++ {
+		var r *dns.Msg
+		if r, _, err = client.Exchange(m, address); err == nil {
+			if r.Rcode != dns.RcodeSuccess {
+				h.Warning.Printf("secondary %s answered the NOTIFY with %s", address, dns.RcodeToString[r.Rcode])
+			}
+			return
+		}
+	}
+	h.Warning.Printf("could not notify secondary %s: %v", address, err)
+}
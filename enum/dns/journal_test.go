@@ -0,0 +1,575 @@
+// Copyright 2016 Hadrien Kohl hadrien.kohl@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dns
+
+import (
+	"enum-dns/enum"
+	layeredbackend "enum-dns/enum/backend/layered"
+	"enum-dns/enum/backend/memory"
+	"github.com/miekg/dns"
+	"math/rand"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Check the serial of the zone, which changes as soon as the data does.
+func checkSerial(t *testing.T, zone *Zone, serial uint32) {
+	if zone.Serial() != serial {
+		t.Fatalf("serial is %d, expected %d", zone.Serial(), serial)
+	}
+}
+
+// A handler of a memory backend with the ranges.
+func followedHandler(t *testing.T, h ENUMHandler, ranges ...enum.NumberRange) (*ENUMHandler, enum.Backend) {
+	backend, err := memory.NewMemoryBackend()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range ranges {
+		if _, err := backend.PushRange(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	h.Backend = &backend
+	h.Info, h.Error, h.Warning, h.Trace = discard, discard, discard, discard
+	return &h, backend
+}
+
+// A secondary of the e164.arpa. zone that transfers the zone from the primary
+// when notified.
+type secondary struct {
+	primary string
+
+	mu          sync.Mutex
+	serial      uint32
+	records     map[string]dns.RR
+	incremental int
+	err         error
+	// Receives the serial after each transfer.
+	transferred chan uint32
+}
+
+func (s *secondary) ServeDNS(writer dns.ResponseWriter, request *dns.Msg) {
+	reply := new(dns.Msg)
+	reply.SetReply(request)
+	writer.WriteMsg(reply)
+	if request.Opcode == dns.OpcodeNotify {
+		go s.refresh()
+	}
+}
+
+// Transfer the changes since the serial of the secondary.
+func (s *secondary) refresh() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	m := new(dns.Msg)
+	m.SetIxfr("e164.arpa.", s.serial, ".", ".")
+	envelopes, err := new(dns.Transfer).In(m, s.primary)
+	if err != nil {
+		s.err = err
+		return
+	}
+	var records []dns.RR
+	for e := range envelopes {
+		if e.Error != nil {
+			s.err = e.Error
+			return
+		}
+		records = append(records, e.RR...)
+	}
+
+	if _, ok := records[1].(*dns.SOA); ok {
+		// The deleted records follow the old SOA records and the added ones
+		// follow the new ones.
+		added := true
+		for _, rr := range records[1 : len(records)-1] {
+			if _, ok := rr.(*dns.SOA); ok {
+				added = !added
+			} else if added {
+				s.records[rr.String()] = rr
+			} else {
+				delete(s.records, rr.String())
+			}
+		}
+		s.incremental++
+	} else if len(records) > 1 {
+		s.records = make(map[string]dns.RR)
+		for _, rr := range records[1 : len(records)-1] {
+			s.records[rr.String()] = rr
+		}
+	}
+	s.serial = records[0].(*dns.SOA).Serial
+	s.transferred <- s.serial
+}
+
+// Wait for the secondary to transfer the serial.
+func (s *secondary) wait(t *testing.T, serial uint32) {
+	for {
+		select {
+		case transferred := <-s.transferred:
+			if transferred == serial {
+				return
+			}
+		case <-time.After(2 * time.Second):
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			t.Fatalf("secondary is at serial %d, expected %d: %v", s.serial, serial, s.err)
+		}
+	}
+}
+
+// The records of the secondary, sorted.
+func (s *secondary) list() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var list []string
+	for k := range s.records {
+		list = append(list, k)
+	}
+	sort.Strings(list)
+	return list
+}
+
+func Test_Follow(t *testing.T) {
+	h, backend := followedHandler(t, ENUMHandler{Zone: NewZone(10)})
+	stop := h.Follow()
+
+	if _, err := backend.PushRange(rangeWithRecords(100000000000000, 199999999999999, 1)); err != nil {
+		t.Fatal(err)
+	}
+	checkSerial(t, h.Zone, 11)
+
+	// A batch is one change.
+	if _, err := backend.Batch([]enum.Operation{
+		{Op: enum.DeleteOperation, Range: enum.NumberRange{Lower: 100000000000000, Upper: 149999999999999}},
+		{Op: enum.PushOperation, Range: enum.NumberRange{Lower: 300000000000000, Upper: 399999999999999}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	checkSerial(t, h.Zone, 12)
+
+	stop()
+	stop()
+	backend.PushRange(enum.NumberRange{Lower: 100000000000000, Upper: 199999999999999})
+	if h.Zone.Serial() != 12 {
+		t.Errorf("serial changed to %d after stop", h.Zone.Serial())
+	}
+}
+
+func Test_JournalBatch(t *testing.T) {
+	h, backend := followedHandler(t, ENUMHandler{
+		Zone:    NewZone(10),
+		Journal: NewJournal(10),
+	}, rangeWithRecords(100000000000000, 100000000000009, 1))
+	defer h.Follow()()
+
+	// The range pushed and deleted by a batch changes no record, the split
+	// range loses the records of its deleted numbers.
+	if _, err := backend.Batch([]enum.Operation{
+		{Op: enum.PushOperation, Range: rangeWithRecords(key(t, "1230"), key(t, "1239"), 1)},
+		{Op: enum.DeleteOperation, Range: enum.NumberRange{Lower: key(t, "1230"), Upper: key(t, "1239")}},
+		{Op: enum.DeleteOperation, Range: enum.NumberRange{Lower: 100000000000002, Upper: 100000000000003}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	checkSerial(t, h.Zone, 11)
+	changes, last, ok := h.Journal.since(10)
+	if !ok || last != 11 || len(changes) != 1 {
+		t.Fatalf("the journal has %v up to %d since 10", changes, last)
+	}
+	var deleted []string
+	for _, rr := range changes[0].deleted {
+		deleted = append(deleted, rr.Header().Name)
+	}
+	expected := []string{"2.0.0.0.0.0.0.0.0.0.0.0.0.0.1.e164.arpa.", "3.0.0.0.0.0.0.0.0.0.0.0.0.0.1.e164.arpa."}
+	if !equalStrings(deleted, expected) || len(changes[0].added) != 0 {
+		t.Errorf("the batch deleted %v and added %v", changes[0].deleted, changes[0].added)
+	}
+}
+
+func Test_Notify(t *testing.T) {
+	s := &secondary{transferred: make(chan uint32, 10)}
+	secondaryAddress, stopSecondary := startServer(t, s)
+	defer stopSecondary()
+
+	h, backend := followedHandler(t, ENUMHandler{
+		Zone:        NewZone(10),
+		TransferACL: localhost(),
+		Journal:     NewJournal(10),
+		Secondaries: []string{secondaryAddress},
+	}, rangeWithRecords(100000000000000, 100000000000009, 1))
+	address, stop := startServer(t, *h)
+	defer stop()
+	defer h.Follow()()
+
+	// The first transfer is a full one.
+	s.primary = address
+	s.refresh()
+	s.wait(t, 10)
+
+	if _, err := backend.PushRange(rangeWithRecords(key(t, "1230"), key(t, "1239"), 2)); err != nil {
+		t.Fatal(err)
+	}
+	s.wait(t, 11)
+
+	if _, err := backend.Batch([]enum.Operation{
+		{Op: enum.DeleteOperation, Range: enum.NumberRange{Lower: 100000000000000, Upper: 100000000000004}},
+		{Op: enum.PushOperation, Range: rangeWithRecords(470000000000005, 470000000000005, 1)},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	s.wait(t, 12)
+
+	if s.incremental != 2 {
+		t.Errorf("%d incremental transfers, expected 2", s.incremental)
+	}
+
+	records, err := transferZone(t, address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var expected []string
+	for _, rr := range records[1 : len(records)-1] {
+		expected = append(expected, rr.String())
+	}
+	sort.Strings(expected)
+	if got := s.list(); !equalStrings(got, expected) {
+		t.Errorf("secondary has\n%v\nexpected\n%v", got, expected)
+	}
+}
+
+func Test_IncrementalTransfer(t *testing.T) {
+	h, backend := followedHandler(t, ENUMHandler{
+		Zone:        NewZone(10),
+		TransferACL: localhost(),
+		Journal:     NewJournal(1),
+	}, rangeWithRecords(100000000000000, 100000000000009, 1))
+	address, stop := startServer(t, *h)
+	defer stop()
+	defer h.Follow()()
+
+	for i := 0; i < 2; i++ {
+		if _, err := backend.PushRange(rangeWithRecords(key(t, "1230"), key(t, "1230"), i+1)); err != nil {
+			t.Fatal(err)
+		}
+		checkSerial(t, h.Zone, uint32(11+i))
+	}
+
+	ixfr := func(serial uint32, client *dns.Client) []dns.RR {
+		m := new(dns.Msg)
+		m.SetIxfr("e164.arpa.", serial, ".", ".")
+		r, _, err := client.Exchange(m, address)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return r.Answer
+	}
+	tcp := &dns.Client{Net: "tcp"}
+
+	if records := ixfr(12, tcp); len(records) != 1 || records[0].(*dns.SOA).Serial != 12 {
+		t.Errorf("an up to date secondary got %v", records)
+	}
+
+	// The journal only keeps the last change.
+	// The last change only adds the second record of the number.
+	records := ixfr(11, tcp)
+	if len(records) != 5 {
+		t.Fatalf("the last change is %v", records)
+	}
+	if _, ok := records[3].(*dns.NAPTR); !ok || records[1].(*dns.SOA).Serial != 11 {
+		t.Errorf("the last change is %v", records)
+	}
+	if records := ixfr(10, tcp); len(records) < 2 || records[1].Header().Rrtype != dns.TypeNS {
+		t.Errorf("an older secondary did not get the whole zone: %v", records)
+	}
+
+	// Over UDP, the SOA record tells to retry over TCP.
+	if records := ixfr(10, new(dns.Client)); len(records) != 1 || records[0].(*dns.SOA).Serial != 12 {
+		t.Errorf("the UDP answer is %v", records)
+	}
+}
+
+func Test_FollowViews(t *testing.T) {
+	view, err := memory.NewMemoryBackend()
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, _ := followedHandler(t, ENUMHandler{
+		Zone:        NewZone(10),
+		TransferACL: localhost(),
+		Journal:     NewJournal(10),
+		Views: []*View{{
+			Name:     "partners",
+			Networks: []*net.IPNet{network(t, "192.0.2.0/24")},
+			Backend:  view,
+		}},
+	}, rangeWithRecords(100000000000000, 199999999999999, 1))
+	address, stop := startServer(t, *h)
+	defer stop()
+	defer h.Follow()()
+
+	if _, err := view.PushRange(rangeWithRecords(key(t, "1230"), key(t, "1239"), 1)); err != nil {
+		t.Fatal(err)
+	}
+	checkSerial(t, h.Zone, 11)
+
+	// The change of the view changes no record of the zone.
+	m := new(dns.Msg)
+	m.SetIxfr("e164.arpa.", 10, ".", ".")
+	r, _, err := (&dns.Client{Net: "tcp"}).Exchange(m, address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Answer) != 4 || r.Answer[1].(*dns.SOA).Serial != 10 || r.Answer[2].(*dns.SOA).Serial != 11 {
+		t.Errorf("the change of the view is %v", r.Answer)
+	}
+}
+
+// A random range of 3, 4 or 15 digits made of ones and twos, so that the
+// ranges of different lengths share their names. It has up to 2 records or is
+// sometimes delegated. The ranges with records have at most 31 numbers.
+func randomRange(r *rand.Rand) enum.NumberRange {
+	length := []int{3, 4, 15}[r.Intn(3)]
+	prefix := ""
+	for i := r.Intn(length) + 1; i > 0; i-- {
+		prefix += string('1' + byte(r.Intn(2)))
+	}
+	first, last, _ := enum.PrefixToKeys(prefix, length)
+	delegated, records := r.Intn(6) == 0, r.Intn(3)
+	if r.Intn(2) == 0 || (!delegated && records > 0) {
+		first += uint64(r.Int63n(int64(last-first) + 1))
+		if last-first > 30 {
+			last = first + 30
+		}
+		last = first + uint64(r.Int63n(int64(last-first)+1))
+	}
+	if !delegated {
+		return rangeWithRecords(first, last, records)
+	}
+	// The name servers in the zone share their glue.
+	return enum.NumberRange{Lower: first, Upper: last, NameServers: []enum.NameServer{
+		{Name: "ns.e164.arpa.", Addresses: []string{"192.0.2.1"}},
+		{Name: "ns" + prefix + ".operator.example."},
+	}}
+}
+
+// Make a random change of the layer, checked like the REST API does. It
+// returns false if nothing changed.
+func randomChange(t *testing.T, r *rand.Rand, b, layer enum.Backend) bool {
+	var ops []enum.Operation
+	for i := r.Intn(2); i >= 0; i-- {
+		op := enum.Operation{Op: enum.PushOperation, Range: randomRange(r)}
+		if r.Intn(4) == 0 {
+			op.Op = enum.DeleteOperation
+		} else if op.Range.Check() != nil || enum.CheckDelegations(b, op.Range) != nil {
+			return false
+		}
+		ops = append(ops, op)
+	}
+	if len(ops) == 2 && ops[0].Op == enum.PushOperation && ops[1].Op == enum.PushOperation &&
+		enum.CheckCut(ops[0].Range, ops[1].Range) != nil {
+		return false
+	}
+	results, err := layer.Batch(ops)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, op := range ops {
+		if op.Op == enum.PushOperation {
+			return true
+		}
+	}
+	return len(results) > 0
+}
+
+// The records of the zone, without the SOA records.
+func zoneSet(t *testing.T, h *ENUMHandler) map[string]bool {
+	records, err := h.zoneRecords()
+	if err != nil {
+		t.Fatal(err)
+	}
+	set := make(map[string]bool)
+	for _, rr := range records[1 : len(records)-1] {
+		set[rr.String()] = true
+	}
+	return set
+}
+
+// Apply the change after the serial to the records of the zone, which are
+// checked. The records are read again if the journal started again. It
+// returns the new serial and whether the change was journaled.
+func checkChange(t *testing.T, h *ENUMHandler, records map[string]bool, serial uint32) (uint32, bool) {
+	checkSerial(t, h.Zone, serial+1)
+	expected := zoneSet(t, h)
+	changes, last, ok := h.Journal.since(serial)
+	if !ok {
+		if !h.Journal.started || h.Journal.serial != serial+1 {
+			t.Fatalf("the journal is not at %d", serial+1)
+		}
+		for rr := range records {
+			delete(records, rr)
+		}
+		for rr := range expected {
+			records[rr] = true
+		}
+		return serial + 1, false
+	}
+	if len(changes) != 1 {
+		t.Fatalf("the journal has %v since %d", changes, serial)
+	}
+	for _, rr := range changes[0].deleted {
+		if !records[rr.String()] {
+			t.Errorf("%s is deleted but not in the zone", rr)
+		}
+		delete(records, rr.String())
+	}
+	for _, rr := range changes[0].added {
+		if records[rr.String()] {
+			t.Errorf("%s is added but already in the zone", rr)
+		}
+		records[rr.String()] = true
+	}
+	for rr := range expected {
+		if !records[rr] {
+			t.Errorf("%s is missing", rr)
+		}
+	}
+	for rr := range records {
+		if !expected[rr] {
+			t.Errorf("%s is left", rr)
+		}
+	}
+	if t.Failed() {
+		t.Fatalf("the zone is\n%s", strings.Join(sortedKeys(expected), "\n"))
+	}
+	return last, true
+}
+
+func Test_JournalChanges(t *testing.T) {
+	for _, layered := range []bool{false, true} {
+		base, _ := memory.NewMemoryBackend()
+		overrides, _ := memory.NewMemoryBackend()
+		backend := base
+		if layered {
+			backend = layeredbackend.NewLayeredBackend(overrides, base)
+		}
+		h, _ := followedHandler(t, ENUMHandler{Zone: NewZone(1), Journal: NewJournal(10)})
+		h.Backend = &backend
+		stop := h.Follow()
+
+		r := rand.New(rand.NewSource(1))
+		records := zoneSet(t, h)
+		serial := h.Zone.Serial()
+		changes, journaled := 0, 0
+		for i := 0; i < 200; i++ {
+			layer := backend
+			if layered && r.Intn(3) == 0 {
+				layer = overrides
+			}
+			if randomChange(t, r, backend, layer) {
+				var ok bool
+				if serial, ok = checkChange(t, h, records, serial); ok {
+					journaled++
+				}
+				changes++
+			}
+		}
+		stop()
+
+		// The changes of a layered backend start the journal again, as do
+		// the changes of the delegations.
+		if layered && journaled > 0 {
+			t.Errorf("%d changes of the layered backend are journaled", journaled)
+		}
+		if !layered && journaled < changes/2 {
+			t.Errorf("%d changes of %d are journaled", journaled, changes)
+		}
+	}
+}
+
+func Test_JournalConcurrentChanges(t *testing.T) {
+	h, backend := followedHandler(t, ENUMHandler{Zone: NewZone(1), Journal: NewJournal(1000)})
+	defer h.Follow()()
+	records := zoneSet(t, h)
+
+	// The changes made while others are committed are journaled once, in the
+	// change that made them.
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(seed int64) {
+			defer wg.Done()
+			r := rand.New(rand.NewSource(seed))
+			for j := 0; j < 100; j++ {
+				rr := randomRange(r)
+				rr.NameServers = nil
+				if _, err := backend.PushRange(rr); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(int64(i))
+	}
+	wg.Wait()
+
+	changes, last, ok := h.Journal.since(1)
+	if !ok || last != 401 || len(changes) != 400 {
+		t.Fatalf("the journal has %d changes up to %d", len(changes), last)
+	}
+	for _, c := range changes {
+		for _, rr := range c.deleted {
+			if !records[rr.String()] {
+				t.Fatalf("%s is deleted but not in the zone", rr)
+			}
+			delete(records, rr.String())
+		}
+		for _, rr := range c.added {
+			if records[rr.String()] {
+				t.Fatalf("%s is added but already in the zone", rr)
+			}
+			records[rr.String()] = true
+		}
+	}
+	if expected := zoneSet(t, h); !equalStrings(sortedKeys(records), sortedKeys(expected)) {
+		t.Errorf("the journal makes\n%s\nexpected\n%s", strings.Join(sortedKeys(records), "\n"),
+			strings.Join(sortedKeys(expected), "\n"))
+	}
+}
+
+func sortedKeys(set map[string]bool) []string {
+	var keys []string
+	for k := range set {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
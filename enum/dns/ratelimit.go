@@ -0,0 +1,270 @@
+// Copyright 2016 Hadrien Kohl hadrien.kohl@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dns
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// Defaults of the rate limiter.
+const (
+	defaultIPv4PrefixLength = 24
+	defaultIPv6PrefixLength = 56
+	defaultQuotaPeriod      = time.Minute
+	defaultMaxPrefixes      = 100000
+	// How often the clients that went quiet are forgotten.
+	sweepInterval = time.Minute
+	// Counts the queries and the responses of the new prefixes once
+	// MaxPrefixes prefixes are counted. It is not the address of a prefix.
+	overflowPrefix = "overflow"
+)
+
+// What to do with a query.
+type verdict int
+
+const (
+	// Answer the query.
+	allow verdict = iota
+	// Send nothing.
+	drop
+	// Send an empty truncated answer so that the client retries over TCP.
+	slip
+	// Refuse the query.
+	refuse
+)
+
+// RateLimitStats holds the counters of a rate limiter.
+type RateLimitStats struct {
+	Dropped   uint64 `json:"dropped"`
+	Truncated uint64 `json:"truncated"`
+	Refused   uint64 `json:"refused"`
+	// Queries, and responses, counted with the ones of the other new
+	// prefixes.
+	Overflowed uint64 `json:"overflowed"`
+	// Prefixes whose responses are counted.
+	Prefixes int `json:"prefixes"`
+	// Prefixes whose queries are counted.
+	Quotas int `json:"quotas"`
+}
+
+// RateLimiter limits the responses sent over UDP to each client prefix, to
+// keep the server from being used to amplify attacks, like the response rate
+// limiting of BIND. Every response counts, the refusals too. It also limits
+// the queries of each client prefix, over every transport, to keep the numbers
+// from being scraped one by one. The zero value limits nothing. A rate
+// limiter can be shared by several handlers.
+type RateLimiter struct {
+	// Responses per second sent over UDP to the clients of a prefix. The
+	// responses are not limited if zero.
+	ResponsesPerSecond int
+	// One in Slip of the responses over the limit is sent empty and truncated
+	// so that legitimate clients retry over TCP; the others are dropped. They
+	// are all dropped if zero.
+	Slip int
+	// Length of the prefixes grouping the IPv4 and IPv6 clients, 24 and 56 if
+	// zero.
+	IPv4PrefixLength, IPv6PrefixLength int
+	// Queries the clients of a prefix may send every QuotaPeriod, a minute
+	// if zero. The queries beyond are refused until the end of the period. No
+	// quota if zero.
+	Quota       int
+	QuotaPeriod time.Duration
+	// Prefixes whose responses, and whose queries, are counted at most,
+	// defaultMaxPrefixes if zero, so that spoofed queries cannot exhaust the
+	// memory. Beyond, the new prefixes share one bucket and one quota until
+	// the others are forgotten: the counted prefixes are never forgotten
+	// early, they could be over their limits.
+	MaxPrefixes int
+
+	mu        sync.Mutex
+	now       func() time.Time
+	prefixes  map[string]*bucket
+	quotas    map[string]*quota
+	lastSweep time.Time
+
+	dropped, truncated, refused, overflowed uint64
+}
+
+// The responses a prefix may still get right away.
+type bucket struct {
+	tokens float64
+	last   time.Time
+	// Responses over the limit.
+	over int
+}
+
+// The queries of a prefix since the start of the period.
+type quota struct {
+	queries int
+	start   time.Time
+}
+
+// Stats returns the current counters.
+func (l *RateLimiter) Stats() RateLimitStats {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return RateLimitStats{
+		Dropped:    l.dropped,
+		Truncated:  l.truncated,
+		Refused:    l.refused,
+		Overflowed: l.overflowed,
+		Prefixes:   len(l.prefixes),
+		Quotas:     len(l.quotas),
+	}
+}
+
+// Decide what to do with a query of the client.
+func (l *RateLimiter) check(addr net.Addr) verdict {
+	var ip net.IP
+	udp := false
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		ip, udp = a.IP, true
+	case *net.TCPAddr:
+		ip = a.IP
+	}
+	if ip == nil {
+		return allow
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	if l.now != nil {
+		now = l.now()
+	}
+	l.sweep(now)
+
+	prefix := l.prefix(ip)
+	over := l.Quota > 0 && !l.countQuery(prefix, now)
+	// The refusals are responses too.
+	if l.ResponsesPerSecond > 0 && udp {
+		if v := l.takeResponse(prefix, now); v != allow {
+			if v == slip {
+				l.truncated++
+			} else {
+				l.dropped++
+			}
+			return v
+		}
+	}
+	if over {
+		l.refused++
+		return refuse
+	}
+	return allow
+}
+
+// The prefix of the client.
+func (l *RateLimiter) prefix(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		length := l.IPv4PrefixLength
+		if length == 0 {
+			length = defaultIPv4PrefixLength
+		}
+		return ip4.Mask(net.CIDRMask(length, 8*net.IPv4len)).String()
+	}
+	length := l.IPv6PrefixLength
+	if length == 0 {
+		length = defaultIPv6PrefixLength
+	}
+	return ip.Mask(net.CIDRMask(length, 8*net.IPv6len)).String()
+}
+
+func (l *RateLimiter) maxPrefixes() int {
+	if l.MaxPrefixes == 0 {
+		return defaultMaxPrefixes
+	}
+	return l.MaxPrefixes
+}
+
+func (l *RateLimiter) quotaPeriod() time.Duration {
+	if l.QuotaPeriod == 0 {
+		return defaultQuotaPeriod
+	}
+	return l.QuotaPeriod
+}
+
+// Count a query of the prefix. It returns false if the prefix is over its
+// quota.
+func (l *RateLimiter) countQuery(prefix string, now time.Time) bool {
+	if l.quotas == nil {
+		l.quotas = make(map[string]*quota)
+	}
+	q := l.quotas[prefix]
+	if q == nil && len(l.quotas) >= l.maxPrefixes() {
+		prefix, q = overflowPrefix, l.quotas[overflowPrefix]
+		l.overflowed++
+	}
+	if q == nil || now.Sub(q.start) >= l.quotaPeriod() {
+		q = &quota{start: now}
+		l.quotas[prefix] = q
+	}
+	q.queries++
+	return q.queries <= l.Quota
+}
+
+// Take a response from the bucket of the prefix. The buckets hold a second
+// of responses and are refilled continuously.
+func (l *RateLimiter) takeResponse(prefix string, now time.Time) verdict {
+	if l.prefixes == nil {
+		l.prefixes = make(map[string]*bucket)
+	}
+	rate := float64(l.ResponsesPerSecond)
+	b := l.prefixes[prefix]
+	if b == nil && len(l.prefixes) >= l.maxPrefixes() {
+		prefix, b = overflowPrefix, l.prefixes[overflowPrefix]
+		l.overflowed++
+	}
+	if b == nil {
+		b = &bucket{tokens: rate, last: now}
+		l.prefixes[prefix] = b
+	}
+	b.tokens += now.Sub(b.last).Seconds() * rate
+	if b.tokens > rate {
+		b.tokens = rate
+	}
+	b.last = now
+
+	if b.tokens >= 1 {
+		b.tokens--
+		return allow
+	}
+	b.over++
+	if l.Slip > 0 && b.over%l.Slip == 0 {
+		return slip
+	}
+	return drop
+}
+
+// Forget the prefixes whose bucket is full again or whose period is over.
+func (l *RateLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < sweepInterval {
+		return
+	}
+	l.lastSweep = now
+	for prefix, b := range l.prefixes {
+		if now.Sub(b.last) >= time.Second {
+			delete(l.prefixes, prefix)
+		}
+	}
+	for prefix, q := range l.quotas {
+		if now.Sub(q.start) >= l.quotaPeriod() {
+			delete(l.quotas, prefix)
+		}
+	}
+}
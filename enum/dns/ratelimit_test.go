@@ -0,0 +1,189 @@
+// Copyright 2016 Hadrien Kohl hadrien.kohl@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dns
+
+import (
+	"fmt"
+	"github.com/miekg/dns"
+	"net"
+	"testing"
+	"time"
+)
+
+// A rate limiter with a clock that only moves when told to.
+func limiterAt(l *RateLimiter) (*RateLimiter, func(time.Duration)) {
+	now := time.Unix(1500000000, 0)
+	l.now = func() time.Time { return now }
+	return l, func(d time.Duration) { now = now.Add(d) }
+}
+
+func udp(ip string) net.Addr { return &net.UDPAddr{IP: net.ParseIP(ip), Port: 5353} }
+func tcp(ip string) net.Addr { return &net.TCPAddr{IP: net.ParseIP(ip), Port: 5353} }
+
+// Check the verdicts of the queries of the client.
+func checkVerdicts(t *testing.T, l *RateLimiter, addr net.Addr, expected ...verdict) {
+	for i, e := range expected {
+		if v := l.check(addr); v != e {
+			t.Errorf("query %d of %s: verdict %d, expected %d", i, addr, v, e)
+		}
+	}
+}
+
+func Test_RateLimitResponses(t *testing.T) {
+	l, advance := limiterAt(&RateLimiter{ResponsesPerSecond: 2, Slip: 2})
+
+	checkVerdicts(t, l, udp("192.0.2.1"), allow, allow, drop, slip, drop, slip)
+	// The clients of the same prefix share the limit.
+	checkVerdicts(t, l, udp("192.0.2.200"), drop, slip)
+	checkVerdicts(t, l, udp("198.51.100.1"), allow, allow, drop)
+	checkVerdicts(t, l, udp("2001:db8:0:ff::1"), allow, allow, drop)
+	checkVerdicts(t, l, udp("2001:db8:0:1ff::1"), allow, allow)
+	// TCP clients cannot be spoofed.
+	checkVerdicts(t, l, tcp("192.0.2.1"), allow, allow, allow)
+
+	advance(500 * time.Millisecond)
+	checkVerdicts(t, l, udp("192.0.2.1"), allow, drop)
+	// The responses over the limit are counted since the start.
+	advance(10 * time.Second)
+	checkVerdicts(t, l, udp("192.0.2.1"), allow, allow, slip)
+
+	if s := l.Stats(); s.Dropped != 6 || s.Truncated != 4 || s.Refused != 0 || s.Prefixes != 4 {
+		t.Errorf("Stats() returned %+v", s)
+	}
+
+	// The prefixes are forgotten once their bucket is full again.
+	advance(sweepInterval)
+	l.check(udp("198.51.100.1"))
+	if s := l.Stats(); s.Prefixes != 1 {
+		t.Errorf("%d prefixes after the sweep, expected 1", s.Prefixes)
+	}
+}
+
+func Test_RateLimitPrefixLength(t *testing.T) {
+	l, _ := limiterAt(&RateLimiter{ResponsesPerSecond: 1, IPv4PrefixLength: 32, IPv6PrefixLength: 128})
+	checkVerdicts(t, l, udp("192.0.2.1"), allow, drop)
+	checkVerdicts(t, l, udp("192.0.2.2"), allow, drop)
+	checkVerdicts(t, l, udp("2001:db8::1"), allow, drop)
+	checkVerdicts(t, l, udp("2001:db8::2"), allow, drop)
+}
+
+func Test_Quota(t *testing.T) {
+	l, advance := limiterAt(&RateLimiter{Quota: 3, QuotaPeriod: time.Hour})
+
+	checkVerdicts(t, l, tcp("192.0.2.1"), allow, allow)
+	checkVerdicts(t, l, udp("192.0.2.1"), allow, refuse, refuse)
+	// Quotas are per prefix, like the responses.
+	checkVerdicts(t, l, udp("192.0.2.2"), refuse)
+	checkVerdicts(t, l, udp("198.51.100.1"), allow)
+
+	advance(time.Hour)
+	checkVerdicts(t, l, udp("192.0.2.1"), allow, allow, allow, refuse)
+
+	if s := l.Stats(); s.Refused != 4 || s.Quotas != 1 {
+		t.Errorf("Stats() returned %+v", s)
+	}
+}
+
+func Test_QuotaResponses(t *testing.T) {
+	l, _ := limiterAt(&RateLimiter{Quota: 1, ResponsesPerSecond: 2})
+
+	// The refusals are responses too.
+	checkVerdicts(t, l, udp("192.0.2.1"), allow, refuse, drop, drop)
+	checkVerdicts(t, l, tcp("192.0.2.1"), refuse, refuse)
+
+	if s := l.Stats(); s.Refused != 3 || s.Dropped != 2 {
+		t.Errorf("Stats() returned %+v", s)
+	}
+}
+
+func Test_MaxPrefixes(t *testing.T) {
+	l, _ := limiterAt(&RateLimiter{Quota: 1, ResponsesPerSecond: 1, MaxPrefixes: 2})
+
+	for _, ip := range []string{"192.0.2.1", "198.51.100.1", "203.0.113.1"} {
+		checkVerdicts(t, l, udp(ip), allow)
+	}
+	// The last prefixes share a bucket and a quota.
+	checkVerdicts(t, l, udp("2001:db8::1"), drop)
+	checkVerdicts(t, l, tcp("2001:db8::1"), refuse)
+	if s := l.Stats(); s.Prefixes != 3 || s.Quotas != 3 || s.Overflowed != 5 {
+		t.Errorf("Stats() returned %+v", s)
+	}
+}
+
+func Test_MaxPrefixesOverLimits(t *testing.T) {
+	l, advance := limiterAt(&RateLimiter{Quota: 2, ResponsesPerSecond: 1, MaxPrefixes: 10})
+	checkVerdicts(t, l, udp("192.0.2.1"), allow, drop)
+	checkVerdicts(t, l, tcp("192.0.2.1"), refuse)
+
+	// Spoofed queries of many prefixes do not reset the limits of the ones
+	// that are counted.
+	for i := 0; i < 100; i++ {
+		l.check(udp(fmt.Sprintf("10.0.%d.1", i)))
+	}
+	checkVerdicts(t, l, udp("192.0.2.1"), drop)
+	checkVerdicts(t, l, tcp("192.0.2.1"), refuse)
+	checkVerdicts(t, l, tcp("198.51.100.1"), refuse)
+	if s := l.Stats(); s.Prefixes != 11 || s.Quotas != 11 {
+		t.Errorf("Stats() returned %+v", s)
+	}
+
+	// The new prefixes are counted on their own once the others are
+	// forgotten.
+	advance(sweepInterval)
+	checkVerdicts(t, l, tcp("198.51.100.1"), allow, allow, refuse)
+}
+
+func Test_RateLimitedHandler(t *testing.T) {
+	limiter, _ := limiterAt(&RateLimiter{ResponsesPerSecond: 1, Slip: 2})
+	address, stop := startCustomHandler(t, ENUMHandler{RateLimiter: limiter},
+		rangeWithRecords(100000000000000, 199999999999999, 1),
+	)
+	defer stop()
+
+	m := new(dns.Msg)
+	m.SetQuestion(enumName("100000000000005"), dns.TypeNAPTR)
+	client := &dns.Client{Timeout: 100 * time.Millisecond}
+
+	if r, _, err := client.Exchange(m, address); err != nil || len(r.Answer) != 1 {
+		t.Fatalf("first answer is %v: %v", r, err)
+	}
+	if _, _, err := client.Exchange(m, address); err == nil {
+		t.Errorf("the answer over the limit was not dropped")
+	}
+	if r, _, err := client.Exchange(m, address); err != nil || !r.Truncated || len(r.Answer) != 0 {
+		t.Errorf("the answer over the limit was not truncated: %v, %v", r, err)
+	}
+	// The client retries over TCP.
+	if r := query(t, "tcp", address, enumName("100000000000005")); len(r.Answer) != 1 {
+		t.Errorf("TCP answer is %v", r)
+	}
+}
+
+func Test_RateLimitedRefusals(t *testing.T) {
+	limiter, _ := limiterAt(&RateLimiter{ResponsesPerSecond: 1})
+	address, stop := startCustomHandler(t, ENUMHandler{RateLimiter: limiter, Allow: []*net.IPNet{network(t, "192.0.2.0/24")}})
+	defer stop()
+
+	m := new(dns.Msg)
+	m.SetQuestion(enumName("100000000000005"), dns.TypeNAPTR)
+	client := &dns.Client{Timeout: 100 * time.Millisecond}
+
+	if r, _, err := client.Exchange(m, address); err != nil || r.Rcode != dns.RcodeRefused {
+		t.Fatalf("first answer is %v: %v", r, err)
+	}
+	if _, _, err := client.Exchange(m, address); err == nil {
+		t.Errorf("the refusal over the limit was not dropped")
+	}
+}
@@ -0,0 +1,333 @@
+// Copyright 2016 Hadrien Kohl hadrien.kohl@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dns
+
+import (
+	"enum-dns/enum"
+	"fmt"
+	"github.com/miekg/dns"
+	"math"
+	"net"
+	"sort"
+	"strings"
+)
+
+// Number of records sent in each message of a zone transfer.
+const transferChunk = 100
+
+// Largest number of names of numbers in a zone transfer. The larger zones are
+// not transferred.
+const maxTransferNames = 100000
+
+// layered is implemented by the backends with an overrides layer.
+type layered interface {
+	Overrides() enum.Backend
+	Base() enum.Backend
+}
+
+// Check whether the client may transfer the zone.
+func (h *ENUMHandler) allowTransfer(addr net.Addr) bool {
+	return longestMatch(h.TransferACL, addrIP(addr)) >= 0
+}
+
+// Send the zone to the client. Transfers are only done to the clients of the
+// ACL, over TCP, except for the incremental transfers that only need the SOA
+// record.
+func (h *ENUMHandler) transfer(writer dns.ResponseWriter, request *dns.Msg) {
+	question := request.Question[0]
+	name := strings.ToLower(dns.Fqdn(question.Name))
+	tcp := writer.RemoteAddr().Network() == "tcp"
+	switch {
+	case name != h.domain():
+		h.writeRcode(writer, request, dns.RcodeNotAuth)
+		return
+	case !h.allowTransfer(writer.RemoteAddr()) || (!tcp && question.Qtype == dns.TypeAXFR):
+		h.Info.Printf("zone transfer refused to %s (%s)", writer.RemoteAddr(), writer.RemoteAddr().Network())
+		h.writeRcode(writer, request, dns.RcodeRefused)
+		return
+	}
+
+	var soa *dns.SOA
+	if question.Qtype == dns.TypeIXFR {
+		if len(request.Ns) == 1 {
+			soa, _ = request.Ns[0].(*dns.SOA)
+		}
+		if soa == nil {
+			h.writeRcode(writer, request, dns.RcodeFormatError)
+			return
+		}
+	}
+
+	// The records are made under the lock of the zone so that they are the
+	// ones of their serial.
+	var records []dns.RR
+	var err error
+	h.zone().mu.RLock()
+	if soa != nil {
+		records, err = h.incrementalRecords(soa.Serial)
+	} else {
+		records, err = h.zoneRecords()
+	}
+	h.zone().mu.RUnlock()
+
+	// Over UDP, the SOA record tells the client to retry over TCP if it is
+	// not up to date.
+	if err == nil && soa != nil && !tcp {
+		answer := h.answerForRequest(request)
+		answer.Answer = records[:1]
+		h.write(writer, request, answer)
+		return
+	}
+	if err != nil {
+		h.Error.Printf("[ERR] Error getting the records of the zone: %v", err)
+		h.writeRcode(writer, request, dns.RcodeServerFailure)
+		return
+	}
+	h.Info.Printf("zone transfer (%s) of %d records to %s", dns.TypeToString[question.Qtype], len(records), writer.RemoteAddr())
+
+	ch := make(chan *dns.Envelope)
+	errs := make(chan error, 1)
+	go func() {
+		errs <- new(dns.Transfer).Out(writer, request, ch)
+	}()
+	for i := 0; i < len(records); i += transferChunk {
+		end := i + transferChunk
+		if end > len(records) {
+			end = len(records)
+		}
+		select {
+		case ch <- &dns.Envelope{RR: records[i:end]}:
+		case err := <-errs:
+			h.Error.Printf("error sending the zone: %v", err)
+			close(ch)
+			return
+		}
+	}
+	close(ch)
+	if err := <-errs; err != nil {
+		h.Error.Printf("error sending the zone: %v", err)
+	}
+}
+
+// Returns the records of an incremental transfer from the serial (RFC 1995).
+// Up to date clients only get the SOA record. The others get the changes
+// since their serial, each one made of the old SOA record, the deleted
+// records, the new SOA record and the added records, between two current SOA
+// records. The whole zone is sent if the journal does not go back to their
+// serial, or to the clients of a view since the journal follows the data
+// without view.
+func (h *ENUMHandler) incrementalRecords(serial uint32) ([]dns.RR, error) {
+	if h.Journal == nil || h.view != nil {
+		return h.zoneRecords()
+	}
+
+	changes, last, ok := h.Journal.since(serial)
+	if !ok {
+		return h.zoneRecords()
+	}
+
+	current := h.soa(last)
+	records := []dns.RR{current}
+	if serial == last {
+		return records, nil
+	}
+	for _, c := range changes {
+		records = append(records, h.soa(c.from))
+		records = append(records, c.deleted...)
+		records = append(records, h.soa(c.to))
+		records = append(records, c.added...)
+	}
+	return append(records, current), nil
+}
+
+// The SOA record of the zone with the given serial.
+func (h *ENUMHandler) soa(serial uint32) dns.RR {
+	soa := h.zone().SOA(h.domain())
+	soa.Serial = serial
+	return soa
+}
+
+// Read all the ranges of the backend.
+func allRanges(b enum.Backend) ([]enum.NumberRange, error) {
+	results := make([]enum.NumberRange, 0)
+	var from uint64
+	for {
+		ranges, err := b.RangesBetween(from, math.MaxInt64, transferChunk)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, ranges...)
+		if len(ranges) < transferChunk {
+			return results, nil
+		}
+		from = ranges[len(ranges)-1].Upper + 1
+	}
+}
+
+// The backends whose ranges make the zone: the base and the overrides of a
+// layered backend.
+func (h *ENUMHandler) layers() []enum.Backend {
+	if l, ok := (*h.Backend).(layered); ok {
+		return []enum.Backend{l.Base(), l.Overrides()}
+	}
+	return []enum.Backend{*h.Backend}
+}
+
+// An owner name of the zone, made of the digits of a number or of the prefix
+// of a delegation, and the range of its records.
+type owner struct {
+	digits string
+	r      enum.NumberRange
+	cut    bool
+}
+
+// Sorts the owners by digits.
+type byDigits []owner
+
+func (o byDigits) Len() int           { return len(o) }
+func (o byDigits) Swap(i, j int)      { o[i], o[j] = o[j], o[i] }
+func (o byDigits) Less(i, j int) bool { return o[i].digits < o[j].digits }
+
+// Returns the records of the zone, starting and ending with the SOA record.
+func (h *ENUMHandler) zoneRecords() ([]dns.RR, error) {
+	var layers [][]enum.NumberRange
+	empty := 0
+	for _, layer := range h.layers() {
+		ranges, err := allRanges(layer)
+		if err != nil {
+			return nil, err
+		}
+		for _, r := range ranges {
+			if len(r.NameServers) == 0 && len(h.records(r)) == 0 {
+				empty++
+			}
+		}
+		layers = append(layers, ranges)
+	}
+	records, glue, err := h.rangeRecords(layers)
+	if err != nil {
+		return nil, err
+	}
+	if empty > 0 {
+		h.Info.Printf("the numbers of %d ranges without records are left out of the zone", empty)
+	}
+
+	domain := h.domain()
+	soa := h.zone().SOA(domain)
+	all := append([]dns.RR{soa}, h.zone().NS(domain)...)
+	all = append(all, records...)
+	all = append(all, glue...)
+	return append(all, soa), nil
+}
+
+// Check whether a range of the layers contains the key. The ranges of each
+// layer are sorted.
+func covered(layers [][]enum.NumberRange, key uint64) bool {
+	for _, ranges := range layers {
+		i := sort.Search(len(ranges), func(i int) bool { return ranges[i].Upper >= key })
+		if i < len(ranges) && ranges[i].Lower <= key {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the records of the sorted ranges of the layers, in order, and the
+// glue of the delegations.
+//
+// Each number of a range has its records at its own name. A wildcard would
+// stand for the numbers of every length and for the names below them, which
+// do not exist on the primary. The numbers of the ranges without records are
+// left out, as their names cannot exist without records. The overrides of a
+// layered backend hide the numbers of the base ranges. The delegated ranges
+// give NS records and glue at the names of their prefixes, which hide
+// everything below them. It fails if the ranges with records have more than
+// maxTransferNames numbers.
+func (h *ENUMHandler) rangeRecords(layers [][]enum.NumberRange) (records, glue []dns.RR, err error) {
+	cuts := make(map[string]enum.NumberRange)
+	for _, ranges := range layers {
+		for _, r := range ranges {
+			if len(r.NameServers) == 0 {
+				continue
+			}
+			prefixes, err := r.Prefixes()
+			if err != nil {
+				return nil, nil, err
+			}
+			for _, p := range prefixes {
+				cuts[p] = r
+			}
+		}
+	}
+
+	// Check whether the digits are at or below a delegation.
+	delegated := func(digits string) bool {
+		for i := 1; i <= len(digits); i++ {
+			if _, ok := cuts[digits[:i]]; ok {
+				return true
+			}
+		}
+		return false
+	}
+
+	var owners byDigits
+	var n uint64
+	for i, ranges := range layers {
+		for _, r := range ranges {
+			if len(r.NameServers) > 0 || len(h.records(r)) == 0 {
+				continue
+			}
+			if n += r.Upper - r.Lower + 1; n > maxTransferNames {
+				return nil, nil, fmt.Errorf("the ranges have more than %d numbers with records", maxTransferNames)
+			}
+			for key := r.Lower; key <= r.Upper; key++ {
+				if covered(layers[i+1:], key) {
+					continue
+				}
+				digits, err := enum.KeyToNumber(key)
+				if err != nil {
+					return nil, nil, err
+				}
+				if !delegated(digits) {
+					owners = append(owners, owner{digits: digits, r: r})
+				}
+			}
+		}
+	}
+	for cut, r := range cuts {
+		if !delegated(cut[:len(cut)-1]) {
+			owners = append(owners, owner{digits: cut, r: r, cut: true})
+		}
+	}
+	sort.Sort(owners)
+
+	// Delegations to the same name servers share their glue.
+	seen := make(map[string]bool)
+	for _, o := range owners {
+		if !o.cut {
+			records = append(records, h.rrs(h.digitsName(o.digits), o.r)...)
+			continue
+		}
+		ns, g := h.delegation(o.digits, o.r)
+		records = append(records, ns...)
+		for _, rr := range g {
+			if !seen[rr.String()] {
+				seen[rr.String()] = true
+				glue = append(glue, rr)
+			}
+		}
+	}
+	return records, glue, nil
+}
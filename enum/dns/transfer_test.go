@@ -0,0 +1,289 @@
+// Copyright 2016 Hadrien Kohl hadrien.kohl@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dns
+
+import (
+	"enum-dns/enum"
+	layeredbackend "enum-dns/enum/backend/layered"
+	"enum-dns/enum/backend/memory"
+	"github.com/miekg/dns"
+	"math/rand"
+	"net"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// Transfer the e164.arpa. zone and return its records.
+func transferZone(t *testing.T, address string) ([]dns.RR, error) {
+	m := new(dns.Msg)
+	m.SetAxfr("e164.arpa.")
+	envelopes, err := new(dns.Transfer).In(m, address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var records []dns.RR
+	for e := range envelopes {
+		if e.Error != nil {
+			return nil, e.Error
+		}
+		records = append(records, e.RR...)
+	}
+	return records, nil
+}
+
+// The owner names of the NAPTR records, sorted.
+func naptrOwners(records []dns.RR) []string {
+	var names []string
+	for _, rr := range records {
+		if rr.Header().Rrtype == dns.TypeNAPTR {
+			names = append(names, rr.Header().Name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func localhost() []*net.IPNet {
+	_, network, _ := net.ParseCIDR("127.0.0.0/8")
+	return []*net.IPNet{network}
+}
+
+func Test_Transfer(t *testing.T) {
+	address, stop := startCustomHandler(t, ENUMHandler{TransferACL: localhost()},
+		rangeWithRecords(key(t, "123000000000000"), key(t, "123000000000002"), 1),
+		rangeWithRecords(key(t, "1230"), key(t, "1231"), 1),
+		rangeWithRecords(470000000000005, 470000000000005, 2),
+		rangeWithRecords(500000000000000, 599999999999999, 0),
+	)
+	defer stop()
+
+	records, err := transferZone(t, address)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(records) < 2 || records[0].Header().Rrtype != dns.TypeSOA || records[len(records)-1].Header().Rrtype != dns.TypeSOA {
+		t.Fatalf("the transfer does not start and end with the SOA record: %v", records)
+	}
+	if records[1].Header().Rrtype != dns.TypeNS {
+		t.Errorf("the transfer has no NS record: %v", records)
+	}
+
+	// Every number has its own name, the ones without records have none.
+	expected := []string{
+		enumName("123000000000000"),
+		enumName("123000000000001"),
+		enumName("123000000000002"),
+		enumName("1230"),
+		enumName("1231"),
+		enumName("470000000000005"),
+		enumName("470000000000005"),
+	}
+	sort.Strings(expected)
+	owners := naptrOwners(records)
+	if !equalStrings(owners, expected) {
+		t.Errorf("the transfer has the NAPTR records of %v, expected %v", owners, expected)
+	}
+}
+
+func Test_TransferTooLarge(t *testing.T) {
+	address, stop := startCustomHandler(t, ENUMHandler{TransferACL: localhost()},
+		rangeWithRecords(100000000000000, 100000000000000+maxTransferNames, 1),
+	)
+	defer stop()
+
+	m := new(dns.Msg)
+	m.SetAxfr("e164.arpa.")
+	r, _, err := (&dns.Client{Net: "tcp"}).Exchange(m, address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Rcode != dns.RcodeServerFailure || len(r.Answer) != 0 {
+		t.Errorf("the transfer of a zone too large returned %v", r)
+	}
+}
+
+// The records of a zone, by owner name.
+type zoneData map[string][]dns.RR
+
+func newZoneData(records []dns.RR) zoneData {
+	z := make(zoneData)
+	for _, rr := range records {
+		if rr.Header().Rrtype != dns.TypeSOA {
+			z[rr.Header().Name] = append(z[rr.Header().Name], rr)
+		}
+	}
+	return z
+}
+
+// Check whether the name exists: it has records or names below it.
+func (z zoneData) exists(name string) bool {
+	for owner := range z {
+		if dns.IsSubDomain(name, owner) {
+			return true
+		}
+	}
+	return false
+}
+
+// Answer the NAPTR query like a secondary serving the zone would (RFC 1034
+// and RFC 4592): the rcode, the answer and whether it is a referral, all as
+// strings.
+func (z zoneData) answer(name string) (int, []string, bool) {
+	// The delegations above the name or at it.
+	labels := dns.SplitDomainName(name)
+	for i := len(labels) - 3; i >= 0; i-- {
+		cut := dns.Fqdn(strings.Join(labels[i:], "."))
+		for _, rr := range z[cut] {
+			if rr.Header().Rrtype == dns.TypeNS {
+				return dns.RcodeSuccess, nil, true
+			}
+		}
+	}
+	strs := func(records []dns.RR, name string) []string {
+		var s []string
+		for _, rr := range records {
+			if rr.Header().Rrtype == dns.TypeNAPTR {
+				rr = dns.Copy(rr)
+				rr.Header().Name = name
+				s = append(s, rr.String())
+			}
+		}
+		sort.Strings(s)
+		return s
+	}
+	if z.exists(name) {
+		return dns.RcodeSuccess, strs(z[name], name), false
+	}
+	// The wildcard of the closest encloser.
+	for i := 1; i < len(labels); i++ {
+		encloser := dns.Fqdn(strings.Join(labels[i:], "."))
+		if z.exists(encloser) {
+			if records, ok := z["*."+encloser]; ok {
+				return dns.RcodeSuccess, strs(records, name), false
+			}
+			break
+		}
+	}
+	return dns.RcodeNameError, nil, false
+}
+
+func Test_TransferAnswers(t *testing.T) {
+	address, stop := startCustomHandler(t, ENUMHandler{TransferACL: localhost()},
+		rangeWithRecords(key(t, "1200"), key(t, "1299"), 1),
+		rangeWithRecords(key(t, "123456"), key(t, "123460"), 2),
+		rangeWithRecords(key(t, "123000000000000"), key(t, "123000000000019"), 1),
+		rangeWithRecords(key(t, "4"), key(t, "4"), 3),
+		rangeWithRecords(key(t, "470000000000005"), key(t, "470000000000005"), 2),
+		delegatedRange(t),
+		enum.NumberRange{Lower: key(t, "55500"), Upper: key(t, "55599"), NameServers: []enum.NameServer{{Name: "ns.example.net."}}},
+	)
+	defer stop()
+
+	records, err := transferZone(t, address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secondary := newZoneData(records)
+
+	// The numbers, the names above and below them, and random names.
+	r := rand.New(rand.NewSource(1))
+	var names []string
+	for _, number := range []string{"12", "123", "1234", "12345", "1230", "1299", "123456", "123460", "1234567",
+		"12300000000000", "123000000000000", "123000000000019", "123000000000020", "1230000000000000",
+		"4", "40", "47", "470000000000005", "4700000000000050", "3316", "33160000000000", "331600000000000",
+		"555", "5550", "55500", "555000"} {
+		names = append(names, enumName(number))
+	}
+	for i := 0; i < 300; i++ {
+		digits := make([]byte, 1+r.Intn(16))
+		for j := range digits {
+			digits[j] = "0123456"[r.Intn(7)]
+		}
+		names = append(names, enumName(string(digits)))
+	}
+
+	for _, name := range names {
+		answer := query(t, "udp", address, name)
+		referral := !answer.Authoritative && len(answer.Ns) > 0 && answer.Ns[0].Header().Rrtype == dns.TypeNS
+		var primary []string
+		for _, rr := range answer.Answer {
+			primary = append(primary, rr.String())
+		}
+		sort.Strings(primary)
+
+		rcode, expected, delegated := secondary.answer(name)
+		if answer.Rcode != rcode || referral != delegated || !equalStrings(primary, expected) {
+			t.Errorf("%s: the primary answers %s %v (referral %v), a secondary %s %v (referral %v)", name,
+				dns.RcodeToString[answer.Rcode], primary, referral, dns.RcodeToString[rcode], expected, delegated)
+		}
+	}
+}
+
+func Test_TransferRefused(t *testing.T) {
+	address, stop := startHandler(t, rangeWithRecords(100000000000000, 199999999999999, 1))
+	defer stop()
+
+	if _, err := transferZone(t, address); err == nil {
+		t.Error("transfer succeeded without ACL")
+	}
+
+	// Transfers are only done over TCP.
+	address, stop = startCustomHandler(t, ENUMHandler{TransferACL: localhost()})
+	defer stop()
+	m := new(dns.Msg)
+	m.SetAxfr("e164.arpa.")
+	r, _, err := new(dns.Client).Exchange(m, address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Rcode != dns.RcodeRefused {
+		t.Errorf("UDP transfer returned %s", dns.RcodeToString[r.Rcode])
+	}
+
+	// Only the zone can be transferred.
+	m.SetAxfr("1.e164.arpa.")
+	r, _, err = (&dns.Client{Net: "tcp"}).Exchange(m, address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Rcode != dns.RcodeNotAuth {
+		t.Errorf("transfer of 1.e164.arpa. returned %s", dns.RcodeToString[r.Rcode])
+	}
+}
+
+func Test_TransferOverrides(t *testing.T) {
+	base, _ := memory.NewMemoryBackend()
+	overrides, _ := memory.NewMemoryBackend()
+	base.PushRange(rangeWithRecords(100000000000000, 100000000000003, 1))
+	base.PushRange(rangeWithRecords(200000000000005, 200000000000005, 1))
+	// The overrides hide the numbers of the base, even without records.
+	overrides.PushRange(enum.NumberRange{Lower: 100000000000001, Upper: 100000000000002})
+	overrides.PushRange(rangeWithRecords(200000000000005, 200000000000005, 3))
+	var backend enum.Backend = layeredbackend.NewLayeredBackend(overrides, base)
+
+	h := ENUMHandler{Backend: &backend, Info: discard, Error: discard, Warning: discard, Trace: discard}
+	records, err := h.zoneRecords()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{enumName("100000000000000"), enumName("100000000000003"),
+		enumName("200000000000005"), enumName("200000000000005"), enumName("200000000000005")}
+	sort.Strings(expected)
+	if owners := naptrOwners(records); !equalStrings(owners, expected) {
+		t.Errorf("the zone has the NAPTR records of %v, expected %v", owners, expected)
+	}
+}
@@ -0,0 +1,125 @@
+// Copyright 2016 Hadrien Kohl hadrien.kohl@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dns
+
+import (
+	"enum-dns/enum"
+	"github.com/miekg/dns"
+	"net"
+)
+
+// View is what the clients of some networks see of the zone: the data of
+// another backend, some of the records, or both.
+type View struct {
+	Name string
+	// Networks of the clients of the view.
+	Networks []*net.IPNet
+	// Backend of the view, the one of the handler if nil.
+	Backend enum.Backend
+	// Keeps the records the clients of the view see, all of them if nil.
+	Filter func(enum.Record) bool
+}
+
+// The address of the client.
+func addrIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP
+	case *net.UDPAddr:
+		return a.IP
+	}
+	return nil
+}
+
+// The length of the prefix of the most specific network containing the
+// address, -1 if none does.
+func longestMatch(networks []*net.IPNet, ip net.IP) int {
+	longest := -1
+	if ip == nil {
+		return longest
+	}
+	for _, network := range networks {
+		if ones, _ := network.Mask.Size(); network.Contains(ip) && ones > longest {
+			longest = ones
+		}
+	}
+	return longest
+}
+
+// Check whether the client may query the zone. The denied clients are
+// refused even if they are allowed.
+func (h *ENUMHandler) allowQuery(addr net.Addr) bool {
+	ip := addrIP(addr)
+	if longestMatch(h.Deny, ip) >= 0 {
+		return false
+	}
+	return len(h.Allow) == 0 || longestMatch(h.Allow, ip) >= 0
+}
+
+// The EDNS Client Subnet option of the request if it comes from a resolver
+// trusted to send it, nil otherwise.
+func (h *ENUMHandler) clientSubnet(addr net.Addr, request *dns.Msg) *dns.EDNS0_SUBNET {
+	opt := request.IsEdns0()
+	if opt == nil || longestMatch(h.ClientSubnetFrom, addrIP(addr)) < 0 {
+		return nil
+	}
+	for _, o := range opt.Option {
+		if subnet, ok := o.(*dns.EDNS0_SUBNET); ok {
+			return subnet
+		}
+	}
+	return nil
+}
+
+// The view of the client: the one with the most specific network containing
+// the address of the client, or the one of its EDNS Client Subnet option. It
+// is nil if no view contains the client.
+func (h *ENUMHandler) chooseView(addr net.Addr, request *dns.Msg) *View {
+	ip := addrIP(addr)
+	if subnet := h.clientSubnet(addr, request); subnet != nil {
+		ip = subnet.Address
+	}
+	var view *View
+	longest := -1
+	for _, v := range h.Views {
+		if l := longestMatch(v.Networks, ip); l > longest {
+			view, longest = v, l
+		}
+	}
+	return view
+}
+
+// Use the backend and the filter of the view.
+func (h *ENUMHandler) useView(view *View) {
+	if view.Backend != nil {
+		b := view.Backend
+		h.Backend = &b
+	}
+	h.view = view
+}
+
+// The records of the range the client sees.
+func (h *ENUMHandler) records(r enum.NumberRange) []enum.Record {
+	if h.view == nil || h.view.Filter == nil {
+		return r.Records
+	}
+	var records []enum.Record
+	for _, record := range r.Records {
+		if h.view.Filter(record) {
+			records = append(records, record)
+		}
+	}
+	return records
+}
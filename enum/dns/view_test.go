@@ -0,0 +1,173 @@
+// Copyright 2016 Hadrien Kohl hadrien.kohl@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dns
+
+import (
+	"enum-dns/enum"
+	"enum-dns/enum/backend/memory"
+	"github.com/miekg/dns"
+	"net"
+	"strings"
+	"testing"
+)
+
+func network(t *testing.T, cidr string) *net.IPNet {
+	_, n, err := net.ParseCIDR(cidr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+// Query the NAPTR records of the number with an EDNS Client Subnet option.
+func queryFromSubnet(t *testing.T, address, number, subnet string) *dns.Msg {
+	n := network(t, subnet)
+	ones, _ := n.Mask.Size()
+	m := new(dns.Msg)
+	m.SetQuestion(enumName(number), dns.TypeNAPTR)
+	m.SetEdns0(4096, false)
+	opt := m.IsEdns0()
+	opt.Option = append(opt.Option, &dns.EDNS0_SUBNET{
+		Code: dns.EDNS0SUBNET, Family: 1, SourceNetmask: uint8(ones), Address: n.IP,
+	})
+	r, _, err := new(dns.Client).Exchange(m, address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+// The gateways of the NAPTR records of the answer.
+func gateways(r *dns.Msg) []string {
+	var list []string
+	for _, rr := range r.Answer {
+		if naptr, ok := rr.(*dns.NAPTR); ok {
+			host := naptr.Regexp[strings.Index(naptr.Regexp, "@")+1:]
+			list = append(list, host[:strings.Index(host, ".")])
+		}
+	}
+	return list
+}
+
+// A memory backend with the ranges.
+func backendWith(t *testing.T, ranges ...enum.NumberRange) enum.Backend {
+	b, err := memory.NewMemoryBackend()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range ranges {
+		if _, err := b.PushRange(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return b
+}
+
+func Test_Views(t *testing.T) {
+	partners := rangeWithRecords(100000000000000, 199999999999999, 1)
+	partners.Records[0].Regexp = "!^(.*)$!sip:\\\\1@sbc.example.com!"
+
+	address, stop := startCustomHandler(t, ENUMHandler{
+		Views: []*View{
+			{
+				Name:     "internal",
+				Networks: []*net.IPNet{network(t, "127.0.0.0/8")},
+				Filter:   func(r enum.Record) bool { return r.Order == 1 },
+			},
+			{
+				Name:     "partners",
+				Networks: []*net.IPNet{network(t, "192.0.2.0/24")},
+				Backend:  backendWith(t, partners),
+			},
+			{
+				Name:     "partner 42",
+				Networks: []*net.IPNet{network(t, "192.0.2.42/32")},
+				Filter:   func(r enum.Record) bool { return false },
+			},
+		},
+		ClientSubnetFrom: localhost(),
+	}, rangeWithRecords(100000000000000, 199999999999999, 2))
+	defer stop()
+
+	r := query(t, "udp", address, enumName("100000000000005"))
+	if g := gateways(r); len(g) != 1 || g[0] != "gateway-1" {
+		t.Errorf("the internal view has the gateways %v", g)
+	}
+
+	r = queryFromSubnet(t, address, "100000000000005", "192.0.2.0/24")
+	if g := gateways(r); len(g) != 1 || g[0] != "sbc" {
+		t.Errorf("the partners view has the gateways %v", g)
+	}
+	var echo *dns.EDNS0_SUBNET
+	if opt := r.IsEdns0(); opt != nil && len(opt.Option) == 1 {
+		echo, _ = opt.Option[0].(*dns.EDNS0_SUBNET)
+	}
+	if echo == nil || echo.SourceScope != 24 || !echo.Address.Equal(net.ParseIP("192.0.2.0")) {
+		t.Errorf("the client subnet option of the answer is %v", r.IsEdns0())
+	}
+
+	// The most specific view applies.
+	r = queryFromSubnet(t, address, "100000000000005", "192.0.2.42/32")
+	if len(r.Answer) != 0 || r.Rcode != dns.RcodeSuccess || len(r.Ns) != 1 {
+		t.Errorf("the view without records answered %v", r)
+	}
+
+	// Clients of no view get everything.
+	r = queryFromSubnet(t, address, "100000000000005", "198.51.100.0/24")
+	if g := gateways(r); len(g) != 2 {
+		t.Errorf("the clients without view get the gateways %v", g)
+	}
+}
+
+func Test_ClientSubnetUntrusted(t *testing.T) {
+	address, stop := startCustomHandler(t, ENUMHandler{
+		Views: []*View{{
+			Name:     "partners",
+			Networks: []*net.IPNet{network(t, "192.0.2.0/24")},
+			Filter:   func(r enum.Record) bool { return false },
+		}},
+	}, rangeWithRecords(100000000000000, 199999999999999, 1))
+	defer stop()
+
+	r := queryFromSubnet(t, address, "100000000000005", "192.0.2.0/24")
+	if len(r.Answer) != 1 {
+		t.Errorf("the client subnet of an untrusted client chose the view: %v", r)
+	}
+	if opt := r.IsEdns0(); opt == nil || len(opt.Option) != 0 {
+		t.Errorf("the client subnet option of an untrusted client is echoed: %v", opt)
+	}
+}
+
+func Test_QueryACL(t *testing.T) {
+	tt := []struct {
+		name        string
+		allow, deny []*net.IPNet
+		rcode       int
+	}{
+		{"no ACL", nil, nil, dns.RcodeSuccess},
+		{"allowed", []*net.IPNet{network(t, "127.0.0.0/8")}, nil, dns.RcodeSuccess},
+		{"not allowed", []*net.IPNet{network(t, "10.0.0.0/8")}, nil, dns.RcodeRefused},
+		{"denied", nil, []*net.IPNet{network(t, "127.0.0.1/32")}, dns.RcodeRefused},
+		{"allowed and denied", []*net.IPNet{network(t, "127.0.0.0/8")}, []*net.IPNet{network(t, "127.0.0.1/32")}, dns.RcodeRefused},
+	}
+	for _, tc := range tt {
+		address, stop := startCustomHandler(t, ENUMHandler{Allow: tc.allow, Deny: tc.deny},
+			rangeWithRecords(100000000000000, 199999999999999, 1))
+		if r := query(t, "udp", address, enumName("100000000000005")); r.Rcode != tc.rcode {
+			t.Errorf("%s: rcode %s, expected %s", tc.name, dns.RcodeToString[r.Rcode], dns.RcodeToString[tc.rcode])
+		}
+		stop()
+	}
+}
@@ -0,0 +1,131 @@
+// Copyright 2016 Hadrien Kohl hadrien.kohl@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dns
+
+import (
+	"github.com/miekg/dns"
+	"sync"
+	"sync/atomic"
+)
+
+// Default values of the apex records.
+const (
+	defaultTtl         = 3600
+	defaultRefresh     = 3600
+	defaultRetry       = 600
+	defaultExpire      = 86400
+	defaultNegativeTtl = 60
+)
+
+// Zone holds the records at the apex of the zone served by an ENUMHandler. The
+// zero values are replaced with defaults and the names are relative to the
+// domain of the handler unless they are fully qualified.
+type Zone struct {
+	// Name servers of the NS records, ns if empty.
+	NameServers []string
+	// Mailbox of the SOA record, hostmaster if empty.
+	Mbox string
+	// TTL of the SOA and NS records.
+	Ttl uint32
+	// Timers of the SOA record.
+	Refresh, Retry, Expire uint32
+	// How long resolvers cache negative answers, the minimum of the SOA record.
+	NegativeTtl uint32
+
+	serial uint32 // Accessed atomically.
+	// Locked while the followed backends commit their changes and the serial
+	// is bumped, read locked while the answers and the transfers are made.
+	mu sync.RWMutex
+}
+
+// NewZone returns a zone whose serial starts at the given value.
+func NewZone(serial uint32) *Zone {
+	return &Zone{serial: serial}
+}
+
+// Zone used by the handlers without one. Its serial never changes.
+var defaultZone = NewZone(1)
+
+// Serial returns the current serial of the SOA record.
+func (z *Zone) Serial() uint32 {
+	return atomic.LoadUint32(&z.serial)
+}
+
+// Bump increments the serial of the SOA record and returns the new one.
+func (z *Zone) Bump() uint32 {
+	return atomic.AddUint32(&z.serial, 1)
+}
+
+// Qualify the name relative to the domain unless it is fully qualified.
+func qualify(name, domain string) string {
+	if dns.IsFqdn(name) {
+		return name
+	}
+	return name + "." + domain
+}
+
+func orDefault(value, def uint32) uint32 {
+	if value == 0 {
+		return def
+	}
+	return value
+}
+
+// SOA returns the SOA record of the zone for the domain.
+func (z *Zone) SOA(domain string) *dns.SOA {
+	mbox := z.Mbox
+	if mbox == "" {
+		mbox = "hostmaster"
+	}
+	return &dns.SOA{
+		Hdr:     dns.RR_Header{Name: domain, Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: orDefault(z.Ttl, defaultTtl)},
+		Ns:      qualify(z.nameServers()[0], domain),
+		Mbox:    qualify(mbox, domain),
+		Serial:  z.Serial(),
+		Refresh: orDefault(z.Refresh, defaultRefresh),
+		Retry:   orDefault(z.Retry, defaultRetry),
+		Expire:  orDefault(z.Expire, defaultExpire),
+		Minttl:  orDefault(z.NegativeTtl, defaultNegativeTtl),
+	}
+}
+
+// NS returns the NS records of the zone for the domain.
+func (z *Zone) NS(domain string) []dns.RR {
+	var records []dns.RR
+	for _, ns := range z.nameServers() {
+		records = append(records, &dns.NS{
+			Hdr: dns.RR_Header{Name: domain, Rrtype: dns.TypeNS, Class: dns.ClassINET, Ttl: orDefault(z.Ttl, defaultTtl)},
+			Ns:  qualify(ns, domain),
+		})
+	}
+	return records
+}
+
+func (z *Zone) nameServers() []string {
+	if len(z.NameServers) == 0 {
+		return []string{"ns"}
+	}
+	return z.NameServers
+}
+
+// Negative returns the SOA record added to the negative answers. Its TTL is
+// the negative TTL if that is lower, as resolvers cache them for that long.
+func (z *Zone) Negative(domain string) *dns.SOA {
+	soa := z.SOA(domain)
+	if soa.Minttl < soa.Hdr.Ttl {
+		soa.Hdr.Ttl = soa.Minttl
+	}
+	return soa
+}
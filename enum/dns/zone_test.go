@@ -0,0 +1,64 @@
+// Copyright 2016 Hadrien Kohl hadrien.kohl@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dns
+
+import (
+	"github.com/miekg/dns"
+	"testing"
+)
+
+func Test_Apex(t *testing.T) {
+	zone := NewZone(2016010100)
+	zone.NameServers = []string{"ns1", "ns2.example.com."}
+	zone.Mbox = "dns-admin.example.com."
+	zone.Ttl = 7200
+	zone.Refresh, zone.Retry, zone.Expire = 1800, 300, 604800
+	zone.NegativeTtl = 30
+
+	address, stop := startZoneHandler(t, zone, rangeWithRecords(100000000000000, 199999999999999, 1))
+	defer stop()
+
+	m := new(dns.Msg)
+	m.SetQuestion("e164.arpa.", dns.TypeSOA)
+	r, _, err := new(dns.Client).Exchange(m, address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "e164.arpa.\t7200\tIN\tSOA\tns1.e164.arpa. dns-admin.example.com. 2016010100 1800 300 604800 30"
+	if len(r.Answer) != 1 || r.Answer[0].String() != expected {
+		t.Errorf("SOA answer is %v, expected %s", r.Answer, expected)
+	}
+
+	m.SetQuestion("e164.arpa.", dns.TypeNS)
+	if r, _, err = new(dns.Client).Exchange(m, address); err != nil {
+		t.Fatal(err)
+	}
+	var ns []string
+	for _, rr := range r.Answer {
+		ns = append(ns, rr.(*dns.NS).Ns)
+	}
+	if len(ns) != 2 || ns[0] != "ns1.e164.arpa." || ns[1] != "ns2.example.com." {
+		t.Errorf("NS answer is %v", r.Answer)
+	}
+
+	// Negative answers are cached for the negative TTL.
+	m.SetQuestion(enumName("200000000000005"), dns.TypeNAPTR)
+	if r, _, err = new(dns.Client).Exchange(m, address); err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Ns) != 1 || r.Ns[0].Header().Ttl != 30 {
+		t.Errorf("authority section of the negative answer is %v", r.Ns)
+	}
+}
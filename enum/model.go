@@ -15,22 +15,124 @@
 package enum
 
 import (
+	"encoding/json"
 	"fmt"
+	"strconv"
+	"strings"
 )
 
+// NumberRange holds the records of the numbers Lower to Upper. The bounds are
+// the keys of numbers of the same length, see NumberToKey.
 type NumberRange struct {
 	Upper   uint64   `json:"upper"`
 	Lower   uint64   `json:"lower"`
 	Records []Record `json:"records"`
+	// TTL of the records in seconds, the default of the server if nil.
+	Ttl *uint32 `json:"ttl,omitempty"`
+	// Name servers the numbers are delegated to, instead of having records.
+	NameServers []NameServer `json:"nameservers,omitempty"`
 }
 
+// NameServer is a name server of a delegated range. The addresses are the
+// glue of the servers named below the delegated names.
+type NameServer struct {
+	Name      string   `json:"name"`
+	Addresses []string `json:"addresses,omitempty"`
+}
+
+// The JSON form of the ranges, whose bounds are numbers written as strings.
+type jsonRange struct {
+	Upper       json.RawMessage `json:"upper,omitempty"`
+	Lower       json.RawMessage `json:"lower,omitempty"`
+	Records     []Record        `json:"records"`
+	Ttl         *uint32         `json:"ttl,omitempty"`
+	NameServers []NameServer    `json:"nameservers,omitempty"`
+}
+
+func (r NumberRange) MarshalJSON() ([]byte, error) {
+	upper, err := KeyToNumber(r.Upper)
+	if err != nil {
+		return nil, err
+	}
+	lower, err := KeyToNumber(r.Lower)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(jsonRange{
+		Upper:       json.RawMessage(strconv.Quote(upper)),
+		Lower:       json.RawMessage(strconv.Quote(lower)),
+		Records:     r.Records,
+		Ttl:         r.Ttl,
+		NameServers: r.NameServers,
+	})
+}
+
+// The bounds can also be JSON numbers, which are padded to 15 digits like the
+// numbers were before they could have other lengths.
+func (r *NumberRange) UnmarshalJSON(data []byte) error {
+	var j jsonRange
+	if err := json.Unmarshal(data, &j); err != nil {
+		return err
+	}
+	var err error
+	if r.Upper, err = unmarshalBound(j.Upper); err != nil {
+		return err
+	}
+	if r.Lower, err = unmarshalBound(j.Lower); err != nil {
+		return err
+	}
+	r.Records, r.Ttl, r.NameServers = j.Records, j.Ttl, j.NameServers
+	return nil
+}
+
+func unmarshalBound(data json.RawMessage) (uint64, error) {
+	if len(data) == 0 || string(data) == "null" {
+		return 0, nil
+	}
+	var number string
+	if err := json.Unmarshal(data, &number); err == nil {
+		return NumberToKey(number)
+	}
+	var prefix uint64
+	if err := json.Unmarshal(data, &prefix); err != nil {
+		return 0, fmt.Errorf("invalid bound %s", data)
+	}
+	return PrefixToE164(prefix)
+}
+
+// Types of the records.
+const (
+	NAPTRRecord = "NAPTR"
+	URIRecord   = "URI"
+	TXTRecord   = "TXT"
+	CNAMERecord = "CNAME"
+)
+
+// Record is a record of the numbers of a range, a NAPTR record unless it has
+// another type. The NAPTR records use the fields Order to Replacement, the URI
+// records (RFC 7553) Priority, Weight and Target, the TXT records Text and the
+// CNAME records Target. The strings are written like in zone files.
 type Record struct {
+	Type        string `json:"type,omitempty"`
 	Order       uint16 `json:"order"`
 	Preference  uint16 `json:"preference"`
 	Flags       string `json:"flags"`
 	Service     string `json:"service"`
 	Regexp      string `json:"regexp"`
 	Replacement string `json:"replacement"`
+	Priority    uint16 `json:"priority,omitempty"`
+	Weight      uint16 `json:"weight,omitempty"`
+	Target      string `json:"target,omitempty"`
+	Text        string `json:"text,omitempty"`
+}
+
+// RecordType returns the type of the record in upper case, NAPTR if it has
+// none.
+func (r Record) RecordType() string {
+	if r.Type == "" {
+		return NAPTRRecord
+	}
+	return strings.ToUpper(r.Type)
 }
 
 // Check if the range overlaps with another.
@@ -56,6 +158,42 @@ func (r *NumberRange) Equals(o NumberRange) bool {
 	return r.Lower == o.Lower && o.Upper == r.Upper
 }
 
+// Subtract returns what is left of the range once o has been removed from it.
+// The result is empty if o contains the range and holds two ranges if o is
+// strictly inside it. The remaining ranges keep the records, TTL and name
+// servers of r.
+func (r *NumberRange) Subtract(o NumberRange) []NumberRange {
+	if !r.OverlapWith(o) {
+		return []NumberRange{*r}
+	}
+	results := make([]NumberRange, 0, 2)
+	if r.Lower < o.Lower {
+		rest := *r
+		rest.Upper = o.Lower - 1
+		results = append(results, rest)
+	}
+	if o.Upper < r.Upper {
+		rest := *r
+		rest.Lower = o.Upper + 1
+		results = append(results, rest)
+	}
+	return results
+}
+
+// Operations of a batch.
+const (
+	PushOperation   = "push"
+	DeleteOperation = "delete"
+)
+
+// Operation is one change of a batch. A push operation pushes Range like
+// PushRange does, a delete operation deletes the numbers between the bounds of
+// Range like DeleteRange does.
+type Operation struct {
+	Op    string      `json:"op"`
+	Range NumberRange `json:"range"`
+}
+
 // RangeOverlapError is returned when an operation fails because
 // a range overlaps with on or more other ranges.
 type RangeOverlapError struct {
@@ -73,6 +211,8 @@ func (e *RangeOverlapError) Error() string {
 	}
 }
 
+// Backend stores the ranges. Implementations must be safe for concurrent use
+// since the DNS and REST servers call them from many goroutines.
 type Backend interface {
 	// RangesBetween returns a list of ranges that enclose the given range l(ower) to u(pper) or
 	// nil if no range matches.
@@ -84,6 +224,19 @@ type Backend interface {
 	// adjusted to make room for the new one and returned.
 	PushRange(r NumberRange) ([]NumberRange, error)
 
+	// GetRange returns the range whose bounds are exactly l(ower) and u(pper) or nil if there
+	// is none.
+	GetRange(l, u uint64) (*NumberRange, error)
+
+	// DeleteRange removes the numbers l(ower) to u(pper) from the backend. Any range overlapping
+	// with them will be deleted or adjusted and returned. The ranges around the gap are left as
+	// they are, they are never merged.
+	DeleteRange(l, u uint64) ([]NumberRange, error)
+
+	// Batch applies the operations in order, all or nothing. It returns what each operation
+	// returned, one after the other. If an operation fails, none of them is applied.
+	Batch(ops []Operation) ([]NumberRange, error)
+
 	// Close the backend.
 	Close() error
 }
@@ -37,7 +37,7 @@ func Test_OverlapsWith(t *testing.T) {
 
 	for _, v := range tt {
 		if r.OverlapWith(v.r) != v.exp {
-			t.Errorf("[%d:%d].OverlapWith([%d:%d]) returned %d, expected %d",
+			t.Errorf("[%d:%d].OverlapWith([%d:%d]) returned %t, expected %t",
 				r.Lower, r.Upper,
 				v.r.Lower, v.r.Upper,
 				r.OverlapWith(v.r), v.exp,
@@ -187,3 +187,61 @@ func Test_Contains(t *testing.T) {
 	}
 
 }
+
+func Test_Subtract(t *testing.T) {
+
+	r := NumberRange{Lower: 400000000000000, Upper: 500000000000000}
+
+	tt := []struct {
+		r   NumberRange
+		exp []NumberRange
+	}{
+		// Inside
+		{NumberRange{Lower: 400000000000000, Upper: 500000000000000}, []NumberRange{}},
+		{NumberRange{Lower: 400000000000001, Upper: 500000000000000}, []NumberRange{
+			{Lower: 400000000000000, Upper: 400000000000000},
+		}},
+		{NumberRange{Lower: 400000000000000, Upper: 499999999999999}, []NumberRange{
+			{Lower: 500000000000000, Upper: 500000000000000},
+		}},
+		{NumberRange{Lower: 400000000000001, Upper: 499999999999999}, []NumberRange{
+			{Lower: 400000000000000, Upper: 400000000000000},
+			{Lower: 500000000000000, Upper: 500000000000000},
+		}},
+
+		// Overlapping
+		{NumberRange{Lower: 399999999999999, Upper: 450000000000000}, []NumberRange{
+			{Lower: 450000000000001, Upper: 500000000000000},
+		}},
+		{NumberRange{Lower: 450000000000000, Upper: 500000000000001}, []NumberRange{
+			{Lower: 400000000000000, Upper: 449999999999999},
+		}},
+		{NumberRange{Lower: 399999999999999, Upper: 500000000000001}, []NumberRange{}},
+
+		// Outside
+		{NumberRange{Lower: 500000000000001, Upper: 500000000000002}, []NumberRange{r}},
+		{NumberRange{Lower: 399999999999997, Upper: 399999999999998}, []NumberRange{r}},
+	}
+
+	for _, v := range tt {
+		result := r.Subtract(v.r)
+		if len(result) != len(v.exp) {
+			t.Errorf("[%d:%d].Subtract([%d:%d]) returned %d ranges, expected %d",
+				r.Lower, r.Upper,
+				v.r.Lower, v.r.Upper,
+				len(result), len(v.exp),
+			)
+			continue
+		}
+		for i := range result {
+			if !result[i].Equals(v.exp[i]) {
+				t.Errorf("[%d:%d].Subtract([%d:%d]) returned [%d:%d] at %d, expected [%d:%d]",
+					r.Lower, r.Upper,
+					v.r.Lower, v.r.Upper,
+					result[i].Lower, result[i].Upper, i,
+					v.exp[i].Lower, v.exp[i].Upper,
+				)
+			}
+		}
+	}
+}
@@ -0,0 +1,304 @@
+// Copyright 2016 Hadrien Kohl hadrien.kohl@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package enum
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// MaxDigits is the length of the longest numbers.
+const MaxDigits = 18
+
+// Length of the E.164 numbers.
+const e164Length = 15
+
+// The numbers are strings of 1 to MaxDigits digits and are stored as keys.
+// Every length has its own block of keys in which the numbers are in order, so
+// numbers of the same length that follow each other have keys that follow each
+// other. The block of the 15 digits numbers starts at zero; those numbers are
+// their own keys, like when every number was padded to 15 digits. The blocks
+// of the other lengths come after it.
+var blocks [MaxDigits + 1]uint64
+
+// The first key that is not a number.
+var maxKey uint64
+
+func init() {
+	next := pow10(e164Length)
+	for n := 1; n <= MaxDigits; n++ {
+		if n != e164Length {
+			blocks[n] = next
+			next += pow10(n)
+		}
+	}
+	maxKey = next
+}
+
+// Lengths returns the lengths of the numbers in the order of their keys.
+func Lengths() []int {
+	lengths := []int{e164Length}
+	for n := 1; n <= MaxDigits; n++ {
+		if n != e164Length {
+			lengths = append(lengths, n)
+		}
+	}
+	return lengths
+}
+
+func pow10(n int) uint64 {
+	p := uint64(1)
+	for i := 0; i < n; i++ {
+		p *= 10
+	}
+	return p
+}
+
+// NumberToKey returns the key of a number made of 1 to MaxDigits digits.
+func NumberToKey(number string) (uint64, error) {
+	if len(number) == 0 || len(number) > MaxDigits {
+		return 0, fmt.Errorf("%q is not a number of 1 to %d digits", number, MaxDigits)
+	}
+	for _, c := range number {
+		if c < '0' || c > '9' {
+			return 0, fmt.Errorf("%q is not a number of 1 to %d digits", number, MaxDigits)
+		}
+	}
+	value, err := strconv.ParseUint(number, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	return blocks[len(number)] + value, nil
+}
+
+// KeyLength returns the length of the number of the key, or 0 if the key is
+// not the key of a number.
+func KeyLength(key uint64) int {
+	if key >= maxKey {
+		return 0
+	}
+	if key < pow10(e164Length) {
+		return e164Length
+	}
+	for n := 1; n <= MaxDigits; n++ {
+		if n != e164Length && blocks[n] <= key && key < blocks[n]+pow10(n) {
+			return n
+		}
+	}
+	return 0
+}
+
+// KeyToNumber returns the number of the key.
+func KeyToNumber(key uint64) (string, error) {
+	n := KeyLength(key)
+	if n == 0 {
+		return "", fmt.Errorf("%d is not the key of a number", key)
+	}
+	number := strconv.FormatUint(key-blocks[n], 10)
+	return strings.Repeat("0", n-len(number)) + number, nil
+}
+
+// PrefixToKeys returns the keys of the first and last numbers of the given
+// length that start with the prefix.
+func PrefixToKeys(prefix string, length int) (first, last uint64, err error) {
+	if len(prefix) > length {
+		return 0, 0, fmt.Errorf("prefix %q is longer than %d digits", prefix, length)
+	}
+	if first, err = NumberToKey(prefix + strings.Repeat("0", length-len(prefix))); err != nil {
+		return 0, 0, err
+	}
+	last, err = NumberToKey(prefix + strings.Repeat("9", length-len(prefix)))
+	return
+}
+
+// Check that the bounds of the range are the keys of numbers of the same
+// length, in order, that its records are valid and that a delegated range has
+// no records and name servers with names and addresses. A CNAME record is the
+// only record of its range. The numbers of a delegated range are delegated
+// under its prefixes, so it cannot hold every number of its length.
+func (r *NumberRange) Check() error {
+	l, u := KeyLength(r.Lower), KeyLength(r.Upper)
+	switch {
+	case l == 0 || u == 0:
+		return errors.New("the bounds are not numbers")
+	case l != u:
+		return fmt.Errorf("the bounds have %d and %d digits", l, u)
+	case r.Lower > r.Upper:
+		return errors.New("the lower bound is greater than the upper bound")
+	}
+	for _, record := range r.Records {
+		switch t := record.RecordType(); t {
+		case NAPTRRecord, TXTRecord:
+		case URIRecord, CNAMERecord:
+			if record.Target == "" {
+				return fmt.Errorf("a %s record has no target", t)
+			}
+			if t == CNAMERecord && len(r.Records) > 1 {
+				return errors.New("a range with a CNAME record cannot have other records")
+			}
+		default:
+			return fmt.Errorf("unknown record type %q", record.Type)
+		}
+	}
+	switch {
+	case len(r.NameServers) == 0:
+		return nil
+	case len(r.Records) > 0:
+		return errors.New("a delegated range cannot have records")
+	case r.Lower == blocks[l] && r.Upper == blocks[l]+pow10(l)-1:
+		return fmt.Errorf("every number of %d digits cannot be delegated", l)
+	}
+	for _, ns := range r.NameServers {
+		if ns.Name == "" {
+			return errors.New("a name server has no name")
+		}
+		for _, a := range ns.Addresses {
+			if net.ParseIP(a) == nil {
+				return fmt.Errorf("invalid address %q of name server %s", a, ns.Name)
+			}
+		}
+	}
+	return nil
+}
+
+// Prefixes returns the shortest list of prefixes, in order, such that the
+// numbers of the length of the range that start with one of them are exactly
+// the numbers of the range. Ex: [1200:1399] -> 12, 13 and [1195:1204] -> 1195
+// to 1204. A range with every number of its length has the empty prefix.
+func (r *NumberRange) Prefixes() ([]string, error) {
+	if err := r.Check(); err != nil {
+		return nil, err
+	}
+	n := KeyLength(r.Lower)
+	lo, hi := r.Lower-blocks[n], r.Upper-blocks[n]
+	var prefixes []string
+	for {
+		// The largest block of numbers starting at lo that fits in the range.
+		k := 0
+		for k < n && lo%pow10(k+1) == 0 && lo+pow10(k+1)-1 <= hi {
+			k++
+		}
+		prefix := ""
+		if k < n {
+			prefix = strconv.FormatUint(lo/pow10(k), 10)
+			prefix = strings.Repeat("0", n-k-len(prefix)) + prefix
+		}
+		prefixes = append(prefixes, prefix)
+		if lo+pow10(k)-1 >= hi {
+			return prefixes, nil
+		}
+		lo += pow10(k)
+	}
+}
+
+// BelowCutError is returned when numbers would be named below the prefix of a
+// delegated range of another length. The name servers of the delegated name
+// answer for every name below it.
+type BelowCutError struct {
+	// Length of the numbers below the prefix.
+	Length int
+	Prefix string
+}
+
+func (e *BelowCutError) Error() string {
+	return fmt.Sprintf("numbers of %d digits are below the delegated prefix %s", e.Length, e.Prefix)
+}
+
+// CheckCut checks that neither range has numbers below the prefixes of the
+// other one if it is delegated. Ranges of the same length never do.
+func CheckCut(r, o NumberRange) error {
+	if err := checkBelow(r, o); err != nil {
+		return err
+	}
+	return checkBelow(o, r)
+}
+
+// Check that the numbers of r are not below the prefixes of d if it is
+// delegated.
+func checkBelow(r, d NumberRange) error {
+	n := KeyLength(r.Lower)
+	if len(d.NameServers) == 0 || KeyLength(d.Lower) == n {
+		return nil
+	}
+	prefixes, err := d.Prefixes()
+	if err != nil {
+		return err
+	}
+	for _, p := range prefixes {
+		if len(p) > n {
+			continue
+		}
+		first, last, err := PrefixToKeys(p, n)
+		if err != nil {
+			return err
+		}
+		if first <= r.Upper && r.Lower <= last {
+			return &BelowCutError{Length: n, Prefix: p}
+		}
+	}
+	return nil
+}
+
+// Number of ranges read at once by CheckDelegations.
+const checkChunk = 100
+
+// CheckDelegations checks with CheckCut the range against the ranges of the
+// other lengths of the backend whose numbers are named at, above or below its
+// own numbers.
+func CheckDelegations(b Backend, r NumberRange) error {
+	if err := r.Check(); err != nil {
+		return err
+	}
+	lower, _ := KeyToNumber(r.Lower)
+	upper, _ := KeyToNumber(r.Upper)
+	for _, length := range Lengths() {
+		if length == len(lower) {
+			continue
+		}
+		// The numbers of this length whose names are at, above or below the
+		// names of the numbers of the range.
+		l, u := lower, upper
+		if length < len(l) {
+			l, u = l[:length], u[:length]
+		}
+		first, _, err := PrefixToKeys(l, length)
+		if err != nil {
+			return err
+		}
+		_, last, err := PrefixToKeys(u, length)
+		if err != nil {
+			return err
+		}
+		for first <= last {
+			ranges, err := b.RangesBetween(first, last, checkChunk)
+			if err != nil {
+				return err
+			}
+			for _, o := range ranges {
+				if err := CheckCut(r, o); err != nil {
+					return err
+				}
+			}
+			if len(ranges) < checkChunk {
+				break
+			}
+			first = ranges[len(ranges)-1].Upper + 1
+		}
+	}
+	return nil
+}
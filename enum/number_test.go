@@ -0,0 +1,331 @@
+// Copyright 2016 Hadrien Kohl hadrien.kohl@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package enum
+
+import (
+	"encoding/json"
+	"math"
+	"strings"
+	"testing"
+)
+
+func Test_NumberToKey(t *testing.T) {
+	tt := []struct {
+		number string
+		key    uint64
+		fail   bool
+	}{
+		{"100000000000000", 100000000000000, false},
+		{"000000000000000", 0, false},
+		{"999999999999999", 999999999999999, false},
+		{"0", 1000000000000000, false},
+		{"9", 1000000000000009, false},
+		{"00", 1000000000000010, false},
+		{"", 0, true},
+		{"12a", 0, true},
+		{"-12", 0, true},
+		{"1234567890123456789", 0, true},
+	}
+	for _, v := range tt {
+		key, err := NumberToKey(v.number)
+		if (err != nil) != v.fail {
+			t.Errorf("NumberToKey(%q) returned the error %v", v.number, err)
+			continue
+		}
+		if !v.fail && key != v.key {
+			t.Errorf("NumberToKey(%q) returned %d, expected %d", v.number, key, v.key)
+		}
+	}
+}
+
+func Test_KeyToNumber(t *testing.T) {
+	// Every length round trips and its block follows the previous one.
+	var previous uint64
+	for n := 1; n <= MaxDigits; n++ {
+		if n == e164Length {
+			continue
+		}
+		for _, number := range []string{zeros(n), nines(n)} {
+			key, err := NumberToKey(number)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if KeyLength(key) != n {
+				t.Errorf("KeyLength(%d) returned %d, expected %d", key, KeyLength(key), n)
+			}
+			if result, err := KeyToNumber(key); err != nil || result != number {
+				t.Errorf("KeyToNumber(%d) returned %q, %v, expected %q", key, result, err, number)
+			}
+		}
+		first, _ := NumberToKey(zeros(n))
+		if previous != 0 && first != previous+1 {
+			t.Errorf("the block of %d digits starts at %d, expected %d", n, first, previous+1)
+		}
+		previous, _ = NumberToKey(nines(n))
+	}
+	if previous >= math.MaxInt64 {
+		t.Errorf("the last key %d does not fit in a signed integer", previous)
+	}
+	if _, err := KeyToNumber(previous + 1); err == nil {
+		t.Errorf("KeyToNumber(%d) succeeded", previous+1)
+	}
+}
+
+func zeros(n int) string {
+	return strings.Repeat("0", n)
+}
+
+func nines(n int) string {
+	return strings.Repeat("9", n)
+}
+
+func Test_PrefixToKeys(t *testing.T) {
+	first, last, err := PrefixToKeys("47", 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f, _ := KeyToNumber(first); f != "4700" {
+		t.Errorf("first number is %s, expected 4700", f)
+	}
+	if l, _ := KeyToNumber(last); l != "4799" {
+		t.Errorf("last number is %s, expected 4799", l)
+	}
+	if _, _, err := PrefixToKeys("4700", 3); err == nil {
+		t.Error("PrefixToKeys succeeded with a prefix longer than the numbers")
+	}
+}
+
+func Test_Lengths(t *testing.T) {
+	lengths := Lengths()
+	if len(lengths) != MaxDigits {
+		t.Fatalf("there are %d lengths, expected %d", len(lengths), MaxDigits)
+	}
+	for i := 1; i < len(lengths); i++ {
+		if blocks[lengths[i-1]] >= blocks[lengths[i]] {
+			t.Errorf("the keys of %d digits come after those of %d digits", lengths[i-1], lengths[i])
+		}
+	}
+}
+
+func Test_Check(t *testing.T) {
+	short, _ := NumberToKey("1234")
+	ns := []NameServer{{Name: "ns1.1.e164.arpa.", Addresses: []string{"192.0.2.1", "2001:db8::1"}}, {Name: "ns.example.com."}}
+	tt := []struct {
+		r    NumberRange
+		fail bool
+	}{
+		{NumberRange{Lower: 100000000000000, Upper: 199999999999999}, false},
+		{NumberRange{Lower: short, Upper: short}, false},
+		{NumberRange{Lower: 199999999999999, Upper: 100000000000000}, true},
+		{NumberRange{Lower: 100000000000000, Upper: short}, true},
+		{NumberRange{Lower: short, Upper: math.MaxUint64}, true},
+		// Typed records.
+		{NumberRange{Lower: short, Upper: short, Records: []Record{{Type: "uri", Target: "sip:info@example.com"}, {Type: "TXT", Text: "carrier"}}}, false},
+		{NumberRange{Lower: short, Upper: short, Records: []Record{{Type: "CNAME", Target: "1.e164.arpa."}}}, false},
+		{NumberRange{Lower: short, Upper: short, Records: []Record{{Type: "CNAME", Target: "1.e164.arpa."}, {Service: "E2U+sip"}}}, true},
+		{NumberRange{Lower: short, Upper: short, Records: []Record{{Type: "URI"}}}, true},
+		{NumberRange{Lower: short, Upper: short, Records: []Record{{Type: "MX"}}}, true},
+		// Delegations.
+		{NumberRange{Lower: 100000000000000, Upper: 199999999999999, NameServers: ns}, false},
+		{NumberRange{Lower: 100000000000000, Upper: 199999999999999, NameServers: ns, Records: []Record{{}}}, true},
+		{NumberRange{Lower: 0, Upper: 999999999999999, NameServers: ns}, true},
+		{NumberRange{Lower: short, Upper: short, NameServers: []NameServer{{Addresses: []string{"192.0.2.1"}}}}, true},
+		{NumberRange{Lower: short, Upper: short, NameServers: []NameServer{{Name: "ns1.example.com.", Addresses: []string{"192.0.2"}}}}, true},
+	}
+	for _, v := range tt {
+		if err := v.r.Check(); (err != nil) != v.fail {
+			t.Errorf("[%d:%d].Check() returned %v", v.r.Lower, v.r.Upper, err)
+		}
+	}
+}
+
+func Test_RangeJSON(t *testing.T) {
+	short, _ := NumberToKey("0123")
+	ttl := uint32(60)
+	r := NumberRange{Lower: short, Upper: short + 10, Ttl: &ttl, Records: []Record{{Order: 10, Service: "E2U+sip"}}}
+
+	data, err := json.Marshal(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `{"upper":"0133","lower":"0123","records":[{"order":10,"preference":0,"flags":"","service":"E2U+sip","regexp":"","replacement":""}],"ttl":60}`
+	if string(data) != expected {
+		t.Errorf("Marshal returned %s, expected %s", data, expected)
+	}
+
+	var decoded NumberRange
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if !decoded.Equals(r) || *decoded.Ttl != ttl || len(decoded.Records) != 1 {
+		t.Errorf("Unmarshal returned %v, expected %v", decoded, r)
+	}
+
+	typed := `{"upper":"199","lower":"100","records":[{"type":"URI","order":0,"preference":0,"flags":"","service":"","regexp":"","replacement":"","priority":10,"weight":1,"target":"sip:info@example.com"}]}`
+	if err := json.Unmarshal([]byte(typed), &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if record := decoded.Records[0]; record.RecordType() != URIRecord || record.Priority != 10 || record.Target != "sip:info@example.com" {
+		t.Errorf("Unmarshal returned the record %v", record)
+	}
+	if data, err := json.Marshal(decoded); err != nil || string(data) != typed {
+		t.Errorf("Marshal returned %s, expected %s", data, typed)
+	}
+
+	delegated := `{"upper":"199","lower":"100","records":null,"nameservers":[{"name":"ns1.1.e164.arpa.","addresses":["192.0.2.1"]}]}`
+	if err := json.Unmarshal([]byte(delegated), &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if len(decoded.NameServers) != 1 || decoded.NameServers[0].Addresses[0] != "192.0.2.1" {
+		t.Errorf("Unmarshal returned the name servers %v", decoded.NameServers)
+	}
+	if data, err := json.Marshal(decoded); err != nil || string(data) != delegated {
+		t.Errorf("Marshal returned %s, expected %s", data, delegated)
+	}
+
+	// Numbers are padded to 15 digits.
+	if err := json.Unmarshal([]byte(`{"lower":47,"upper":479999999999999}`), &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if decoded.Lower != 470000000000000 || decoded.Upper != 479999999999999 {
+		t.Errorf("Unmarshal returned [%d:%d]", decoded.Lower, decoded.Upper)
+	}
+
+	for _, data := range []string{`{"lower":"12a"}`, `{"lower":0}`, `{"lower":true}`} {
+		if err := json.Unmarshal([]byte(data), &decoded); err == nil {
+			t.Errorf("Unmarshal(%s) succeeded", data)
+		}
+	}
+}
+
+func Test_Prefixes(t *testing.T) {
+	tt := []struct {
+		lower, upper string
+		prefixes     []string
+	}{
+		{"1200", "1399", []string{"12", "13"}},
+		{"1195", "1204", []string{"1195", "1196", "1197", "1198", "1199", "1200", "1201", "1202", "1203", "1204"}},
+		{"1234", "1234", []string{"1234"}},
+		{"0000", "9999", []string{""}},
+		{"0100", "1999", []string{"01", "02", "03", "04", "05", "06", "07", "08", "09", "1"}},
+		{"100000000000000", "199999999999999", []string{"1"}},
+	}
+	for _, v := range tt {
+		lower, _ := NumberToKey(v.lower)
+		upper, _ := NumberToKey(v.upper)
+		r := NumberRange{Lower: lower, Upper: upper}
+		prefixes, err := r.Prefixes()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Join(prefixes, ",") != strings.Join(v.prefixes, ",") {
+			t.Errorf("[%s:%s].Prefixes() returned %v, expected %v", v.lower, v.upper, prefixes, v.prefixes)
+		}
+		checkCovering(t, r, prefixes)
+	}
+
+	// At most 9 prefixes of each length on both sides of the range.
+	ranges := []NumberRange{
+		{Lower: 470000000000000, Upper: 471234599999999},
+		{Lower: 123456789012345, Upper: 987654321098765},
+		{Lower: 100000000000001, Upper: 999999999999998},
+	}
+	for _, r := range ranges {
+		prefixes, err := r.Prefixes()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(prefixes) > 2*9*15 {
+			t.Errorf("[%d:%d].Prefixes() returned %d prefixes", r.Lower, r.Upper, len(prefixes))
+		}
+		checkCovering(t, r, prefixes)
+	}
+}
+
+// Check that the prefixes cover exactly the numbers of the range, in order.
+func checkCovering(t *testing.T, r NumberRange, prefixes []string) {
+	n := KeyLength(r.Lower)
+	next := r.Lower
+	for _, p := range prefixes {
+		first, last, err := PrefixToKeys(p, n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if first != next {
+			t.Errorf("prefix %s starts at %d, expected %d", p, first, next)
+		}
+		next = last + 1
+	}
+	if next != r.Upper+1 {
+		t.Errorf("the prefixes end at %d, expected %d", next-1, r.Upper)
+	}
+}
+
+// A backend with sorted ranges, for the checks that read them.
+type sliceBackend struct {
+	Backend
+	ranges []NumberRange
+}
+
+func (b sliceBackend) RangesBetween(l, u uint64, c int) ([]NumberRange, error) {
+	var ranges []NumberRange
+	for _, r := range b.ranges {
+		if r.Upper >= l && r.Lower <= u && len(ranges) < c {
+			ranges = append(ranges, r)
+		}
+	}
+	return ranges, nil
+}
+
+func Test_CheckDelegations(t *testing.T) {
+	key := func(number string) uint64 {
+		k, err := NumberToKey(number)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return k
+	}
+	ns := []NameServer{{Name: "ns.example.com."}}
+	b := sliceBackend{ranges: []NumberRange{
+		{Lower: key("3316000000"), Upper: key("3316999999"), NameServers: ns},
+		{Lower: key("4012345678"), Upper: key("4012345678")},
+	}}
+
+	tt := []struct {
+		r      NumberRange
+		prefix string // Of the error, none if empty.
+	}{
+		{NumberRange{Lower: key("331600000000000"), Upper: key("331600000000009")}, "3316"},
+		{NumberRange{Lower: key("33160000051"), Upper: key("33160000051")}, "3316"},
+		{NumberRange{Lower: key("3316"), Upper: key("3316")}, "3316"},
+		{NumberRange{Lower: key("300000000000000"), Upper: key("399999999999999")}, "3316"},
+		{NumberRange{Lower: key("331500000000000"), Upper: key("331599999999999")}, ""},
+		{NumberRange{Lower: key("331"), Upper: key("331")}, ""},
+		{NumberRange{Lower: key("3316000000"), Upper: key("3316000009")}, ""},
+		// Delegated ranges cannot have numbers of other lengths below them.
+		{NumberRange{Lower: key("400000000000000"), Upper: key("409999999999999"), NameServers: ns}, "40"},
+		{NumberRange{Lower: key("401000000000000"), Upper: key("401199999999999"), NameServers: ns}, ""},
+		{NumberRange{Lower: key("401234567800000"), Upper: key("401234567899999"), NameServers: ns}, "4012345678"},
+	}
+	for _, v := range tt {
+		err := CheckDelegations(b, v.r)
+		if v.prefix == "" && err != nil {
+			t.Errorf("[%d:%d]: %v", v.r.Lower, v.r.Upper, err)
+		}
+		if e, ok := err.(*BelowCutError); v.prefix != "" && (!ok || e.Prefix != v.prefix) {
+			t.Errorf("[%d:%d]: the error is %v, expected the prefix %s", v.r.Lower, v.r.Upper, err, v.prefix)
+		}
+	}
+}
@@ -18,12 +18,14 @@ import (
 	"encoding/json"
 	"enum-dns/enum"
 	"errors"
+	"expvar"
 	"fmt"
 	"github.com/gorilla/mux"
 	"io"
 	"log"
 	"net/http"
 	"net/url"
+	"sort"
 	"strconv"
 	"time"
 )
@@ -36,25 +38,61 @@ type HttpEndpoint struct {
 const PUT_LIMIT = 1048576
 const RETURN_LIMIT = 100
 
+// layered is implemented by the backends with an overrides layer.
+type layered interface {
+	Overrides() enum.Backend
+}
+
+// CreateHttpHandlerFor serves the API of the backend under /api/.
 func CreateHttpHandlerFor(b *enum.Backend, ui http.Handler) http.Handler {
+	return CreateHttpHandlerForPaths(map[string]enum.Backend{"": *b}, ui)
+}
+
+// CreateHttpHandlerForPaths serves the API of each backend under /api/ followed
+// by its path, which is empty or ends with a slash.
+func CreateHttpHandlerForPaths(backends map[string]enum.Backend, ui http.Handler) http.Handler {
 
 	r := mux.NewRouter().StrictSlash(true)
 
-	h := HttpEndpoint{
-		backend: *b,
+	// The longer paths first so that /api/ does not hide them.
+	var paths []string
+	for path := range backends {
+		paths = append(paths, path)
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(paths)))
+	for _, path := range paths {
+		mount(r, "/api/"+path, backends[path])
 	}
 
-	numRe := "[1-9][0-9]{0,14}"
+	r.PathPrefix("/ui").Handler(http.StripPrefix("/ui", ui))
+	r.Path("/debug/vars").Handler(expvar.Handler())
+
+	return &HttpEndpoint{handler: r}
+}
 
-	api := r.PathPrefix("/api/").Subrouter()
-	api.Path("/interval/{from:"+numRe+"}:{to:"+numRe+"}").Methods("PUT", "GET").HandlerFunc(h.GetAndEditHandler)
-	api.Path("/interval").Methods("GET").HandlerFunc(h.SearchHandler)
+// Register the API of the backend under the prefix.
+func mount(r *mux.Router, prefix string, b enum.Backend) {
+	// The overrides are managed with the same API under override/.
+	if l, ok := b.(layered); ok {
+		overrides := HttpEndpoint{backend: l.Overrides()}
+		overrides.routes(r.PathPrefix(prefix + "override/").Subrouter())
+	}
+	h := HttpEndpoint{backend: b}
+	h.routes(r.PathPrefix(prefix).Subrouter())
+}
 
-	r.PathPrefix("/ui").Handler(http.StripPrefix("/ui", ui))
+// Register the API routes of the endpoint.
+func (h *HttpEndpoint) routes(api *mux.Router) {
 
-	h.handler = r
+	numRe := "[0-9]{1," + strconv.Itoa(enum.MaxDigits) + "}"
 
-	return &h
+	interval := api.Path("/interval/{from:" + numRe + "}:{to:" + numRe + "}").Subrouter()
+	interval.Methods("GET").HandlerFunc(h.GetHandler)
+	interval.Methods("PUT").HandlerFunc(h.PutHandler)
+	interval.Methods("DELETE").HandlerFunc(h.DeleteHandler)
+	api.Path("/interval").Methods("GET").HandlerFunc(h.SearchHandler)
+	api.Path("/batch").Methods("POST").HandlerFunc(h.BatchHandler)
+	api.Path("/events").Methods("GET").HandlerFunc(h.EventsHandler)
 }
 
 func (h *HttpEndpoint) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -74,37 +112,37 @@ func (h *HttpEndpoint) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 // Parse and return the limit and order variables from request.
 func Pagination(vars url.Values) (after, before uint64, limit int64, err error) {
 	if l := vars.Get("limit"); l != "" {
-		limit, err = strconv.ParseInt(l, 10, 32)
+		if limit, err = strconv.ParseInt(l, 10, 32); err != nil {
+			return
+		}
 	}
 	if a := vars.Get("after"); a != "" {
-		after, err = strconv.ParseUint(a, 10, 64)
+		if after, err = enum.NumberToKey(a); err != nil {
+			return
+		}
 	}
 	if b := vars.Get("before"); b != "" {
-		before, err = strconv.ParseUint(b, 10, 64)
+		before, err = enum.NumberToKey(b)
 	}
 	return
 }
 
-// Parse prefix and compute corresponding from and to.
+// Parse prefix and compute corresponding from and to. The numbers are 15
+// digits long unless the length variable says otherwise.
 func Prefix(vars url.Values) (from, to uint64, err error) {
 
 	if p := vars.Get("prefix"); p == "" {
 		return 0, 0, nil
 	}
 
-	prefix, err := strconv.ParseUint(vars.Get("prefix"), 10, 64)
-	if err != nil {
-		return 0, 0, err
-	}
-
-	from, err = enum.PrefixToE164(prefix)
-	if err != nil {
-		return 0, 0, err
+	length := 15
+	if l := vars.Get("length"); l != "" {
+		if length, err = strconv.Atoi(l); err != nil {
+			return 0, 0, err
+		}
 	}
 
-	to, _ = enum.PrefixToE164(prefix + 1)
-
-	return
+	return enum.PrefixToKeys(vars.Get("prefix"), length)
 }
 
 // Extract and validate from and to variables.
@@ -121,16 +159,20 @@ func FromAndTo(vars url.Values) (from, to uint64, err error) {
 		return 0, 0, errors.New("missing from or to.")
 	}
 
-	from, err = strconv.ParseUint(vars.Get("from"), 10, 64)
+	from, err = enum.NumberToKey(vars.Get("from"))
 	if err != nil {
 		return 0, 0, fmt.Errorf("imposible to parse %s", vars.Get("from"))
 	}
 
-	to, err = strconv.ParseUint(vars.Get("to"), 10, 64)
+	to, err = enum.NumberToKey(vars.Get("to"))
 	if err != nil {
 		return 0, 0, fmt.Errorf("imposible to parse %s", vars.Get("to"))
 	}
 
+	if enum.KeyLength(from) != enum.KeyLength(to) {
+		return 0, 0, errors.New("from and to have different lengths")
+	}
+
 	return
 
 }
@@ -146,12 +188,42 @@ func WriteError(w http.ResponseWriter, err error, status int) bool {
 	return true
 }
 
-func (h *HttpEndpoint) GetAndEditHandler(w http.ResponseWriter, r *http.Request) {
-
+// Extract the from and to variables of the interval path.
+func intervalVars(r *http.Request) (from, to uint64, err error) {
 	vars := mux.Vars(r)
+	if from, err = enum.NumberToKey(vars["from"]); err != nil {
+		return
+	}
+	if to, err = enum.NumberToKey(vars["to"]); err != nil {
+		return
+	}
+	interval := enum.NumberRange{Lower: from, Upper: to}
+	err = interval.Check()
+	return
+}
+
+func (h *HttpEndpoint) GetHandler(w http.ResponseWriter, r *http.Request) {
+
+	from, to, err := intervalVars(r)
+	if WriteError(w, err, http.StatusBadRequest) {
+		return
+	}
+
+	result, err := h.backend.GetRange(from, to)
+	if WriteError(w, err, http.StatusInternalServerError) {
+		return
+	}
+	if result == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	json.NewEncoder(w).Encode(result)
+}
+
+func (h *HttpEndpoint) PutHandler(w http.ResponseWriter, r *http.Request) {
 
-	from, err := strconv.ParseUint(vars["from"], 10, 64)
-	to, err := strconv.ParseUint(vars["to"], 10, 64)
+	from, to, err := intervalVars(r)
 	if WriteError(w, err, http.StatusBadRequest) {
 		return
 	}
@@ -161,27 +233,130 @@ func (h *HttpEndpoint) GetAndEditHandler(w http.ResponseWriter, r *http.Request)
 		WriteError(w, err, http.StatusBadRequest)
 		return
 	}
+	// The path decides what interval is written.
+	insert.Lower, insert.Upper = from, to
+	if !h.checkDelegations(w, []enum.NumberRange{insert}) {
+		return
+	}
 
-	results, err := h.backend.RangesBetween(from, to, 2)
+	results, err := h.backend.PushRange(insert)
 	if WriteError(w, err, http.StatusInternalServerError) {
 		return
 	}
 
-	if len(results) != 1 {
-		WriteError(w, nil, http.StatusNotFound)
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(results)
+}
+
+func (h *HttpEndpoint) DeleteHandler(w http.ResponseWriter, r *http.Request) {
+
+	from, to, err := intervalVars(r)
+	if WriteError(w, err, http.StatusBadRequest) {
 		return
 	}
 
-	if r.Method == "PUT" {
-		_, err = h.backend.PushRange(insert)
-		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			w.Write([]byte(err.Error()))
+	results, err := h.backend.DeleteRange(from, to)
+	if WriteError(w, err, http.StatusInternalServerError) {
+		return
+	}
+	if len(results) == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	json.NewEncoder(w).Encode(results)
+}
+
+func (h *HttpEndpoint) BatchHandler(w http.ResponseWriter, r *http.Request) {
+
+	var ops []enum.Operation
+	if err := json.NewDecoder(io.LimitReader(r.Body, PUT_LIMIT)).Decode(&ops); err != nil {
+		WriteError(w, err, http.StatusBadRequest)
+		return
+	}
+	var pushed []enum.NumberRange
+	for _, op := range ops {
+		if op.Op != enum.PushOperation && op.Op != enum.DeleteOperation {
+			WriteError(w, fmt.Errorf("unknown operation %q", op.Op), http.StatusBadRequest)
+			return
+		}
+		if op.Op == enum.PushOperation {
+			pushed = append(pushed, op.Range)
+		}
+	}
+	if !h.checkDelegations(w, pushed) {
+		return
+	}
+
+	results, err := h.backend.Batch(ops)
+	if WriteError(w, err, http.StatusInternalServerError) {
+		return
+	}
+
+	json.NewEncoder(w).Encode(results)
+}
+
+// Check that the pushed ranges are not below the delegated prefixes of the
+// ranges of the backend or of each other, and the other way around. The
+// ranges deleted by a batch are still checked against. It writes the error
+// and returns false if they are.
+func (h *HttpEndpoint) checkDelegations(w http.ResponseWriter, pushed []enum.NumberRange) bool {
+	for i, r := range pushed {
+		err := enum.CheckDelegations(h.backend, r)
+		for j := 0; err == nil && j < i; j++ {
+			err = enum.CheckCut(r, pushed[j])
+		}
+		if _, ok := err.(*enum.BelowCutError); ok {
+			WriteError(w, err, http.StatusConflict)
+			return false
+		}
+		if WriteError(w, err, http.StatusInternalServerError) {
+			return false
+		}
+	}
+	return true
+}
+
+// Stream the changes of the backend as Server-Sent Events. The stream ends if
+// the client does not keep up, it then has to read the data again.
+func (h *HttpEndpoint) EventsHandler(w http.ResponseWriter, r *http.Request) {
+
+	watcher, ok := h.backend.(enum.Watcher)
+	if !ok {
+		WriteError(w, errors.New("the backend does not notify its changes"), http.StatusNotImplemented)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		WriteError(w, errors.New("streaming is not supported"), http.StatusInternalServerError)
+		return
+	}
+
+	events, stop := watcher.Watch()
+	defer stop()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	for {
+		select {
+		case e, ok := <-events:
+			if !ok {
+				return
+			}
+			data, err := json.Marshal(e)
+			if err != nil {
+				return
+			}
+			if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.Type, data); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-r.Context().Done():
 			return
 		}
-		w.WriteHeader(http.StatusCreated)
-	} else {
-		json.NewEncoder(w).Encode(results[0])
 	}
 }
 
@@ -223,7 +398,8 @@ func (h *HttpEndpoint) SearchHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if after != 0 {
+	// Zero is the key of a number, the cursors are set if they are given.
+	if vars.Get("after") != "" {
 		if !(from <= after && after < to) {
 			w.WriteHeader(http.StatusBadRequest)
 			w.Write([]byte(errors.New("after value outside from and to").Error()))
@@ -231,7 +407,7 @@ func (h *HttpEndpoint) SearchHandler(w http.ResponseWriter, r *http.Request) {
 		}
 		from = after
 	}
-	if before != 0 {
+	if vars.Get("before") != "" {
 		if !(from < before && before <= to) {
 			w.WriteHeader(http.StatusBadRequest)
 			w.Write([]byte(errors.New("before value outside from and to").Error()))
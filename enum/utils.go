@@ -16,8 +16,8 @@ package enum
 
 import (
 	"errors"
+	"fmt"
 	"math"
-	"strconv"
 	"strings"
 )
 
@@ -30,12 +30,16 @@ func Reverse(s string) string {
 	return string(r)
 }
 
-// Convert a enum DNS request to unsigned integer
+// Convert the digits of an ENUM name to the key of the number. Ex: 4.3.2.1
+// -> key of 1234. Every label has to be a single digit.
 func ConvertEnumToInt(enum string) (uint64, error) {
-	// Remove the points.
-	enum = strings.Replace(enum, ".", "", -1)
-	enum = Reverse(enum)
-	return strconv.ParseUint(enum, 10, 64)
+	labels := strings.Split(enum, ".")
+	for _, label := range labels {
+		if len(label) != 1 || label[0] < '0' || label[0] > '9' {
+			return 0, fmt.Errorf("malformed label %q", label)
+		}
+	}
+	return NumberToKey(Reverse(strings.Join(labels, "")))
 }
 
 // Make any number 15 digits long by padding zeros
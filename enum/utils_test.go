@@ -29,17 +29,33 @@ func TestReverse(t *testing.T) {
 }
 
 func TestConvertEnumToInt(t *testing.T) {
-
-	expected := uint64(4741067196)
-	enumString, err := ConvertEnumToInt("6.9.1.7.6.0.1.4.7.4")
-	if err != nil {
-		t.Error("Unexpeted error ", err)
+	tt := []struct {
+		in   string
+		exp  string
+		fail bool
+	}{
+		{"6.9.1.7.6.0.1.4.7.4", "4741067196", false},
+		{"6.9.1.7.6.0.1.4.7.4.0.0", "004741067196", false},
+		{"5.0.0.0.0.0.0.0.0.0.0.0.0.0.1", "100000000000005", false},
+		{"6.9.1.7.6.0.1.4.7.74", "", true},
+		{"6.9.1.x.6", "", true},
+		{"6..1", "", true},
+		{"", "", true},
+		{"1.2.3.4.5.6.7.8.9.0.1.2.3.4.5.6.7.8.9", "", true},
 	}
-
-	if enumString != expected {
-		t.Error("Expected ", enumString, " got ", expected)
+	for _, v := range tt {
+		key, err := ConvertEnumToInt(v.in)
+		if (err != nil) != v.fail {
+			t.Errorf("ConvertEnumToInt(%q) returned the error %v", v.in, err)
+			continue
+		}
+		if v.fail {
+			continue
+		}
+		if number, _ := KeyToNumber(key); number != v.exp {
+			t.Errorf("ConvertEnumToInt(%q) returned the key of %s, expected %s", v.in, number, v.exp)
+		}
 	}
-
 }
 
 func TestPrefixToE164(t *testing.T) {
@@ -0,0 +1,208 @@
+// Copyright 2016 Hadrien Kohl hadrien.kohl@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package enum
+
+import (
+	"sync"
+)
+
+// Types of events.
+const (
+	PushedEvent  = "pushed"
+	TrimmedEvent = "trimmed"
+	DeletedEvent = "deleted"
+)
+
+// Event describes the change of one range. A pushed range has no Before value
+// and a deleted range has no After value. A range that is split in two is
+// reported as two trimmed events with the same Before value.
+type Event struct {
+	Type   string       `json:"type"`
+	Before *NumberRange `json:"before,omitempty"`
+	After  *NumberRange `json:"after,omitempty"`
+	// Number of the change of the backend the event belongs to, a batch being
+	// one change. The events of a change have the same number, the numbers of
+	// the next changes are greater.
+	Change uint64 `json:"change"`
+}
+
+// Watcher is implemented by the backends that notify their changes.
+type Watcher interface {
+	// Watch returns a channel receiving the events of every change made to the
+	// backend and a function to stop watching. The channel is closed when the
+	// watcher is stopped or if it does not keep up with the changes, in which
+	// case the watcher has to read the data again.
+	Watch() (<-chan Event, func())
+}
+
+// Observer is implemented by the backends that let others take part in their
+// changes.
+type Observer interface {
+	// Observe calls f with the events of every change made to the backend
+	// until the returned function is called. Each change becomes visible
+	// while l is locked and f is called before l is unlocked, so that the
+	// holders of l never see the change without what f does. The changes are
+	// observed one at a time, in order.
+	Observe(l sync.Locker, f func(events []Event)) func()
+}
+
+// Observe observes the backend if it implements Observer. Otherwise f is never
+// called.
+func Observe(b Backend, l sync.Locker, f func(events []Event)) func() {
+	if o, ok := b.(Observer); ok {
+		return o.Observe(l, f)
+	}
+	return func() {}
+}
+
+// Watch watches the backend if it implements Watcher. Otherwise the returned
+// channel never receives anything and is only closed when stopped.
+func Watch(b Backend) (<-chan Event, func()) {
+	if w, ok := b.(Watcher); ok {
+		return w.Watch()
+	}
+	ch := make(chan Event)
+	var once sync.Once
+	return ch, func() { once.Do(func() { close(ch) }) }
+}
+
+// Events returns the events of a change that removed the numbers of r from
+// the overlapping ranges and added the pushed ones.
+func Events(r NumberRange, overlaps []NumberRange, pushed ...NumberRange) []Event {
+	events := make([]Event, 0, len(overlaps)+len(pushed))
+	for i := range overlaps {
+		before := &overlaps[i]
+		rest := before.Subtract(r)
+		if len(rest) == 0 {
+			events = append(events, Event{Type: DeletedEvent, Before: before})
+		}
+		for j := range rest {
+			events = append(events, Event{Type: TrimmedEvent, Before: before, After: &rest[j]})
+		}
+	}
+	for i := range pushed {
+		events = append(events, Event{Type: PushedEvent, After: &pushed[i]})
+	}
+	return events
+}
+
+// Size of the channels returned by Notifier.Watch.
+const watchBuffer = 256
+
+// Notifier sends the events of the changes to observers and watchers. It
+// implements Observer and Watcher and can be embedded by backends. The zero
+// value is ready to use.
+type Notifier struct {
+	mu       sync.Mutex
+	watchers map[chan Event]bool
+	// The observers, in the order their locks are taken.
+	observers []*observer
+	// Number of the last change.
+	change uint64
+}
+
+type observer struct {
+	l sync.Locker
+	f func(events []Event)
+}
+
+func (n *Notifier) Observe(l sync.Locker, f func(events []Event)) func() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	o := &observer{l: l, f: f}
+	n.observers = append(n.observers, o)
+	return func() {
+		n.mu.Lock()
+		defer n.mu.Unlock()
+		for i := range n.observers {
+			if n.observers[i] == o {
+				n.observers = append(n.observers[:i:i], n.observers[i+1:]...)
+				break
+			}
+		}
+	}
+}
+
+func (n *Notifier) Watch() (<-chan Event, func()) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.watchers == nil {
+		n.watchers = make(map[chan Event]bool)
+	}
+	ch := make(chan Event, watchBuffer)
+	n.watchers[ch] = true
+	return ch, func() {
+		n.mu.Lock()
+		defer n.mu.Unlock()
+		n.remove(ch)
+	}
+}
+
+// Commit makes a change visible with publish, under the locks of the
+// observers, and sends its events if it succeeds. The backends commit their
+// changes one at a time, in order. The events are numbered with the change;
+// without events, nothing changed and nothing is sent.
+func (n *Notifier) Commit(publish func() error, events ...Event) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	locked := make(map[sync.Locker]bool)
+	for _, o := range n.observers {
+		if !locked[o.l] {
+			locked[o.l] = true
+			o.l.Lock()
+			defer o.l.Unlock()
+		}
+	}
+	if err := publish(); err != nil || len(events) == 0 {
+		return err
+	}
+	n.change++
+	for i := range events {
+		events[i].Change = n.change
+	}
+	for _, o := range n.observers {
+		o.f(events)
+	}
+	n.send(events)
+	return nil
+}
+
+// Notify sends the events of a change that is already visible.
+func (n *Notifier) Notify(events ...Event) {
+	n.Commit(func() error { return nil }, events...)
+}
+
+// Send the events to every watcher. It never blocks; the watchers that cannot
+// receive all the events are closed.
+func (n *Notifier) send(events []Event) {
+	for ch := range n.watchers {
+	send:
+		for _, e := range events {
+			select {
+			case ch <- e:
+			default:
+				n.remove(ch)
+				break send
+			}
+		}
+	}
+}
+
+func (n *Notifier) remove(ch chan Event) {
+	if n.watchers[ch] {
+		delete(n.watchers, ch)
+		close(ch)
+	}
+}
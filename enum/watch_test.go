@@ -0,0 +1,152 @@
+// Copyright 2016 Hadrien Kohl hadrien.kohl@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package enum
+
+import (
+	"errors"
+	"sync"
+	"testing"
+)
+
+func Test_Events(t *testing.T) {
+
+	r := NumberRange{Lower: 400000000000000, Upper: 500000000000000}
+	overlaps := []NumberRange{
+		{Lower: 300000000000000, Upper: 399999999999999},
+		{Lower: 400000000000000, Upper: 450000000000000},
+		{Lower: 450000000000001, Upper: 600000000000000},
+	}
+
+	events := Events(r, overlaps[1:2], r)
+	if len(events) != 2 || events[0].Type != DeletedEvent || events[1].Type != PushedEvent {
+		t.Errorf("Events returned %v, expected a deleted and a pushed event", events)
+	}
+
+	events = Events(NumberRange{Lower: 350000000000000, Upper: 350000000000000}, overlaps[0:1])
+	if len(events) != 2 || events[0].Type != TrimmedEvent || events[1].Type != TrimmedEvent {
+		t.Fatalf("Events returned %v, expected two trimmed events", events)
+	}
+	if events[0].After.Upper != 349999999999999 || events[1].After.Lower != 350000000000001 {
+		t.Errorf("Events returned %v and %v, expected the two sides of the split",
+			*events[0].After, *events[1].After)
+	}
+}
+
+func Test_Notifier(t *testing.T) {
+	var n Notifier
+
+	slow, _ := n.Watch()
+	fast, stop := n.Watch()
+
+	for i := 0; i < watchBuffer; i++ {
+		n.Notify(Event{Type: PushedEvent})
+		<-fast
+	}
+	n.Notify(Event{Type: DeletedEvent})
+
+	// The slow watcher is closed once it has received what fit in its buffer.
+	count := 0
+	for range slow {
+		count++
+	}
+	if count != watchBuffer {
+		t.Errorf("slow watcher received %d events, expected %d", count, watchBuffer)
+	}
+
+	if e := <-fast; e.Type != DeletedEvent {
+		t.Errorf("fast watcher received %v, expected a deleted event", e)
+	}
+	stop()
+	if _, ok := <-fast; ok {
+		t.Error("fast watcher not closed when stopped")
+	}
+	// Stopping twice is harmless.
+	stop()
+}
+
+// A mutex that tells whether it is locked.
+type testLocker struct {
+	sync.Mutex
+	locked bool
+}
+
+func (l *testLocker) Lock() {
+	l.Mutex.Lock()
+	l.locked = true
+}
+
+func (l *testLocker) Unlock() {
+	l.locked = false
+	l.Mutex.Unlock()
+}
+
+func Test_NotifierCommit(t *testing.T) {
+	var n Notifier
+	l := new(testLocker)
+	var observed [][]Event
+	stop := n.Observe(l, func(events []Event) {
+		if !l.locked {
+			t.Error("observer called without the lock")
+		}
+		observed = append(observed, events)
+	})
+	// The observers sharing a lock are called under it too.
+	shared := 0
+	n.Observe(l, func(events []Event) { shared++ })
+	ch, _ := n.Watch()
+
+	// A change that fails is neither observed nor sent.
+	failed := errors.New("failed")
+	if err := n.Commit(func() error { return failed }, Event{Type: PushedEvent}); err != failed {
+		t.Errorf("Commit returned %v, expected %v", err, failed)
+	}
+	// Nor is a change without events.
+	n.Commit(func() error { return nil })
+
+	published := false
+	err := n.Commit(func() error {
+		if !l.locked {
+			t.Error("change published without the lock")
+		}
+		published = true
+		return nil
+	}, Event{Type: DeletedEvent}, Event{Type: PushedEvent})
+	if err != nil || !published {
+		t.Fatalf("Commit returned %v, published %v", err, published)
+	}
+	if len(observed) != 1 || len(observed[0]) != 2 || shared != 1 {
+		t.Fatalf("observed %v, %d by the second observer", observed, shared)
+	}
+	for _, e := range observed[0] {
+		if e.Change != 1 {
+			t.Errorf("observed %v, expected change 1", e)
+		}
+	}
+	if e := <-ch; e.Type != DeletedEvent || e.Change != 1 {
+		t.Errorf("watcher received %v, expected a deleted event of change 1", e)
+	}
+	if e := <-ch; e.Type != PushedEvent || e.Change != 1 {
+		t.Errorf("watcher received %v, expected a pushed event of change 1", e)
+	}
+
+	stop()
+	n.Notify(Event{Type: PushedEvent})
+	if len(observed) != 1 || shared != 2 {
+		t.Errorf("observed %d changes after stop, %d by the second observer", len(observed), shared)
+	}
+	if e := <-ch; e.Change != 2 {
+		t.Errorf("watcher received %v, expected change 2", e)
+	}
+}
@@ -15,23 +15,38 @@
 package main
 
 import (
+	"crypto/tls"
 	"enum-dns/enum"
+	"enum-dns/enum/backend/cache"
+	"enum-dns/enum/backend/layered"
 	"enum-dns/enum/backend/memory"
+	sqlbackend "enum-dns/enum/backend/sql"
 	enumdns "enum-dns/enum/dns"
 	"enum-dns/enum/rest"
+	"expvar"
+	"fmt"
+	_ "github.com/go-sql-driver/mysql"
 	"github.com/miekg/dns"
 	"github.com/spf13/viper"
 	"log"
+	"math"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"regexp"
+	"sort"
+	"strings"
 	"syscall"
+	"time"
 )
 
 func main() {
 
 	viper.SetDefault("dns.address", "127.0.0.1:5354")
-	viper.SetDefault("dns.domain", "e164.arpa.")
+	viper.SetDefault("dns.udpsize", 1232)
+	viper.SetDefault("dns.https.path", "/dns-query")
+	viper.SetDefault("dns.ratelimit.slip", 2)
 
 	// Initialize the loggers.
 	Info := log.New(os.Stdout,
@@ -50,62 +65,419 @@ func main() {
 		"TRACE: ",
 		log.Ldate|log.Ltime|log.Lshortfile)
 
-	// Memory
-	backend, err := memory.NewMemoryBackend()
-	if err != nil {
-		Error.Fatalf("backend: could not start the backend: %v", err)
+	// The configuration file is optional.
+	viper.SetConfigName("enum-dns")
+	viper.AddConfigPath("/etc/enum-dns/")
+	viper.AddConfigPath(".")
+	if err := viper.ReadInConfig(); err != nil {
+		if _, ok := err.(viper.ConfigFileNotFoundError); !ok {
+			Error.Fatalf("config: could not read the configuration: %v", err)
+		}
+	}
+
+	// Without a list of zones, the configuration describes the only zone.
+	var zones []*zone
+	if config := viper.GetStringMap("zones"); len(config) > 0 {
+		var names []string
+		for name := range config {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		domains := make(map[string]string)
+		for _, name := range names {
+			z, err := createZone(name, viper.Sub("zones."+name))
+			if err != nil {
+				Error.Fatalf("zone %s: %v", name, err)
+			}
+			if other, ok := domains[z.handler.Domain]; ok {
+				Error.Fatalf("zone %s: domain %s is already served by zone %s", name, z.handler.Domain, other)
+			}
+			domains[z.handler.Domain] = name
+			zones = append(zones, z)
+		}
+	} else {
+		z, err := createZone("", viper.GetViper())
+		if err != nil {
+			Error.Fatalf("backend: could not start the backend: %v", err)
+		}
+		if viper.GetString("backend") == "memory" {
+			if ranges, _ := z.backend.RangesBetween(0, math.MaxInt64, 1); len(ranges) == 0 {
+				z.backend.PushRange(enum.NumberRange{
+					Lower: 100000000000000,
+					Upper: 999999999999999,
+					Records: []enum.Record{
+						{Regexp: "!^(.*)$!sip:\\@default!", Service: "E2U+sip",
+							Preference: 100, Replacement: ".", Order: 10},
+					},
+				})
+			}
+		}
+		zones = append(zones, z)
 	}
-	defer backend.Close()
 
-	backend.PushRange(enum.NumberRange{
-		Lower: 100000000000000,
-		Upper: 999999999999999,
-		Records: []enum.Record{
-			{Regexp: "!^(.*)$!sip:\\@default!", Service: "E2U+sip",
-				Preference: 100, Replacement: ".", Order: 10},
-		},
-	})
+	// The limits apply to the clients of every zone.
+	var limiter *enumdns.RateLimiter
+	if viper.GetInt("dns.ratelimit.responses") > 0 || viper.GetInt("dns.ratelimit.quota") > 0 {
+		limiter = &enumdns.RateLimiter{
+			ResponsesPerSecond: viper.GetInt("dns.ratelimit.responses"),
+			Slip:               viper.GetInt("dns.ratelimit.slip"),
+			IPv4PrefixLength:   viper.GetInt("dns.ratelimit.ipv4prefix"),
+			IPv6PrefixLength:   viper.GetInt("dns.ratelimit.ipv6prefix"),
+			Quota:              viper.GetInt("dns.ratelimit.quota"),
+			QuotaPeriod:        viper.GetDuration("dns.ratelimit.quotaperiod"),
+			MaxPrefixes:        viper.GetInt("dns.ratelimit.maxprefixes"),
+		}
+		expvar.Publish("ratelimit", expvar.Func(func() interface{} { return limiter.Stats() }))
+	}
 
-	domain := dns.Fqdn(viper.GetString("dns.domain"))
 	address := viper.GetString("dns.address")
-	dnsHandler := enumdns.ENUMHandler{
-		Info: Info, Warning: Warning, Trace: Trace, Error: Error,
-		Backend: &backend,
+	for _, z := range zones {
+		defer z.backend.Close()
+		for _, v := range z.handler.Views {
+			if v.Backend != nil {
+				defer v.Backend.Close()
+			}
+		}
+
+		z.handler.Info, z.handler.Warning, z.handler.Trace, z.handler.Error = Info, Warning, Trace, Error
+		z.handler.UDPSize = uint16(viper.GetInt("dns.udpsize"))
+		z.handler.RateLimiter = limiter
+		defer z.handler.Follow()()
+		dns.Handle(z.handler.Domain, z.handler)
+		Info.Printf("Serving zone %s", z.handler.Domain)
 	}
-	server := &dns.Server{Addr: address, Net: "udp"}
-	dns.Handle(domain, dnsHandler)
 
-	go func() {
-		Info.Printf("Starting enum dns server on %v", address)
-		if err := server.ListenAndServe(); err != nil {
-			Error.Fatalf("dns: error starting udp server: %v", err)
+	// Resolvers retry over TCP when a UDP answer is truncated.
+	servers := []*dns.Server{
+		{Addr: address, Net: "udp"},
+		{Addr: address, Net: "tcp"},
+	}
+
+	// DNS over TLS and HTTPS share the certificate.
+	var tlsConfig *tls.Config
+	if viper.IsSet("dns.tls.cert") {
+		certificate, err := tls.LoadX509KeyPair(viper.GetString("dns.tls.cert"), viper.GetString("dns.tls.key"))
+		if err != nil {
+			Error.Fatalf("dns.tls: could not load the certificate: %v", err)
 		}
-	}()
+		tlsConfig = &tls.Config{Certificates: []tls.Certificate{certificate}}
+	}
+	if a := viper.GetString("dns.tls.address"); a != "" {
+		if tlsConfig == nil {
+			Error.Fatalf("dns.tls: DNS over TLS needs a certificate")
+		}
+		servers = append(servers, &dns.Server{Addr: a, Net: "tcp-tls", TLSConfig: tlsConfig})
+	}
+
+	for _, server := range servers {
+		go func(server *dns.Server) {
+			Info.Printf("Starting enum dns server on %v (%s)", server.Addr, server.Net)
+			if err := server.ListenAndServe(); err != nil {
+				Error.Fatalf("dns: error starting %s server: %v", server.Net, err)
+			}
+		}(server)
+	}
+
+	if a := viper.GetString("dns.https.address"); a != "" {
+		if tlsConfig == nil {
+			Error.Fatalf("dns.tls: DNS over HTTPS needs a certificate")
+		}
+		mux := http.NewServeMux()
+		mux.Handle(viper.GetString("dns.https.path"), enumdns.NewDoHHandler(dns.DefaultServeMux))
+		server := &http.Server{Addr: a, Handler: mux, TLSConfig: tlsConfig}
+		go func() {
+			Info.Printf("Starting enum dns server on %v (https)", a)
+			if err := server.ListenAndServeTLS("", ""); err != nil {
+				Error.Fatalf("dns: error starting https server: %v", err)
+			}
+		}()
+	}
 
 	go func() {
 
-		handler := rest.CreateHttpHandlerFor(&backend,
-			// TODO Check that the directory exists.
-			http.FileServer(
-				http.Dir("./ui/dist/"),
-			),
+		// TODO Check that the directory exists.
+		ui := http.FileServer(
+			http.Dir("./ui/dist/"),
 		)
 
+		// The single zone is served under /api/ and the zones under
+		// /api/zones/{name}/, their views under views/{name}/.
+		backends := make(map[string]enum.Backend)
+		for _, z := range zones {
+			path := ""
+			if z.name != "" {
+				path = "zones/" + z.name + "/"
+			}
+			backends[path] = z.backend
+			for _, v := range z.handler.Views {
+				if v.Backend != nil {
+					backends[path+"views/"+v.Name+"/"] = v.Backend
+				}
+			}
+		}
+		handler := rest.CreateHttpHandlerForPaths(backends, ui)
+
 		if err := http.ListenAndServe(":8080", handler); err != nil {
 			Error.Fatalf("http: error starting http server: %s", err)
 		}
 	}()
 
 	// Wait for signal or error from the dns server.
-	sig := make(chan os.Signal)
+	sig := make(chan os.Signal, 1)
 	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
 	for {
 		select {
 		case s := <-sig:
-			server.Shutdown()
+			for _, server := range servers {
+				server.Shutdown()
+			}
 			// TODO Handle the http server shutdown as well
 			// Fatalf calls os.Exit(1)
 			Error.Fatalf("Signal (%d) received, stopping\n", s)
 		}
 	}
 }
+
+// A zone served by enum-dns with its own backend.
+type zone struct {
+	name    string
+	backend enum.Backend
+	handler enumdns.ENUMHandler
+}
+
+// Create the zone described by the configuration: a backend configuration
+// with a dns section describing the zone itself.
+func createZone(name string, config *viper.Viper) (*zone, error) {
+	if name != "" && !config.IsSet("dns.domain") {
+		return nil, fmt.Errorf("missing dns.domain")
+	}
+	config.SetDefault("dns.domain", "e164.arpa.")
+	// The serial starts from the current time so that it does not go back
+	// when the server is restarted.
+	config.SetDefault("dns.soa.serial", time.Now().Unix())
+	config.SetDefault("dns.journal", 100)
+
+	prefix := ""
+	if name != "" {
+		prefix = name + "."
+	}
+	backend, err := createBackend(prefix, config)
+	if err != nil {
+		return nil, err
+	}
+
+	apex := enumdns.NewZone(uint32(config.GetInt64("dns.soa.serial")))
+	apex.NameServers = config.GetStringSlice("dns.ns")
+	apex.Mbox = config.GetString("dns.soa.mbox")
+	apex.Ttl = uint32(config.GetInt("dns.soa.ttl"))
+	apex.Refresh = uint32(config.GetInt("dns.soa.refresh"))
+	apex.Retry = uint32(config.GetInt("dns.soa.retry"))
+	apex.Expire = uint32(config.GetInt("dns.soa.expire"))
+	apex.NegativeTtl = uint32(config.GetInt("dns.soa.negativettl"))
+
+	acl, err := parseNetworks(config.GetStringSlice("dns.transfer"))
+	if err != nil {
+		backend.Close()
+		return nil, fmt.Errorf("dns.transfer: %v", err)
+	}
+	networks := make(map[string][]*net.IPNet)
+	for _, key := range []string{"dns.allow", "dns.deny", "dns.clientsubnet"} {
+		if networks[key], err = parseNetworks(config.GetStringSlice(key)); err != nil {
+			backend.Close()
+			return nil, fmt.Errorf("%s: %v", key, err)
+		}
+	}
+
+	signer, err := createSigner(config)
+	if err != nil {
+		backend.Close()
+		return nil, fmt.Errorf("dns.dnssec: %v", err)
+	}
+
+	views, err := createViews(prefix, config)
+	if err != nil {
+		backend.Close()
+		return nil, fmt.Errorf("dns.views: %v", err)
+	}
+
+	var journal *enumdns.Journal
+	if size := config.GetInt("dns.journal"); size > 0 {
+		journal = enumdns.NewJournal(size)
+	}
+
+	z := &zone{name: name, backend: backend}
+	z.handler = enumdns.ENUMHandler{
+		Backend:     &z.backend,
+		Domain:      dns.Fqdn(config.GetString("dns.domain")),
+		Zone:        apex,
+		Ttl:         uint32(config.GetInt("dns.ttl")),
+		TransferACL: acl,
+		Journal:     journal,
+		Secondaries: config.GetStringSlice("dns.notify"),
+		Signer:      signer,
+		Allow:       networks["dns.allow"],
+		Deny:        networks["dns.deny"],
+		Views:       views,
+
+		ClientSubnetFrom: networks["dns.clientsubnet"],
+	}
+	return z, nil
+}
+
+// Create the views of the dns.views section, sorted by name. Each view has
+// the networks of its clients and optionally a backend configuration and a
+// filter of the records.
+func createViews(prefix string, config *viper.Viper) ([]*enumdns.View, error) {
+	var names []string
+	for name := range config.GetStringMap("dns.views") {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var views []*enumdns.View
+	for _, name := range names {
+		view, err := createView(prefix+"views."+name+".", name, config.Sub("dns.views."+name))
+		if err != nil {
+			for _, v := range views {
+				if v.Backend != nil {
+					v.Backend.Close()
+				}
+			}
+			return nil, fmt.Errorf("%s: %v", name, err)
+		}
+		views = append(views, view)
+	}
+	return views, nil
+}
+
+func createView(prefix, name string, config *viper.Viper) (*enumdns.View, error) {
+	networks, err := parseNetworks(config.GetStringSlice("networks"))
+	if err != nil {
+		return nil, fmt.Errorf("networks: %v", err)
+	}
+	view := &enumdns.View{Name: name, Networks: networks}
+
+	// The service and regexp select the NAPTR records.
+	if filter := config.Sub("filter"); filter != nil {
+		service := filter.GetString("service")
+		var re *regexp.Regexp
+		if filter.IsSet("regexp") {
+			if re, err = regexp.Compile(filter.GetString("regexp")); err != nil {
+				return nil, fmt.Errorf("filter: %v", err)
+			}
+		}
+		types := make(map[string]bool)
+		for _, t := range filter.GetStringSlice("types") {
+			types[strings.ToUpper(t)] = true
+		}
+		view.Filter = func(r enum.Record) bool {
+			if len(types) > 0 && !types[r.RecordType()] {
+				return false
+			}
+			if r.RecordType() != enum.NAPTRRecord {
+				return true
+			}
+			return (service == "" || strings.EqualFold(r.Service, service)) && (re == nil || re.MatchString(r.Regexp))
+		}
+	}
+
+	if config.IsSet("backend") {
+		if view.Backend, err = createBackend(prefix, config); err != nil {
+			return nil, err
+		}
+	}
+	return view, nil
+}
+
+// Create the signer of the zone from the keys of the dnssec section, nil if
+// there is no ZSK. The ZSK signs the DNSKEY records as well without a KSK.
+func createSigner(config *viper.Viper) (*enumdns.Signer, error) {
+	if !config.IsSet("dns.dnssec.zsk") {
+		return nil, nil
+	}
+	zsk, err := enumdns.ReadKey(config.GetString("dns.dnssec.zsk"))
+	if err != nil {
+		return nil, err
+	}
+	signer := &enumdns.Signer{ZSK: zsk, Validity: config.GetDuration("dns.dnssec.validity")}
+	if config.IsSet("dns.dnssec.ksk") {
+		if signer.KSK, err = enumdns.ReadKey(config.GetString("dns.dnssec.ksk")); err != nil {
+			return nil, err
+		}
+	}
+	return signer, nil
+}
+
+// Parse a list of networks in CIDR notation or of single addresses.
+func parseNetworks(values []string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, v := range values {
+		if !strings.Contains(v, "/") {
+			ip := net.ParseIP(v)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address %q", v)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(v)
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// Create the backend described by the configuration. The cache statistics are
+// published with the given prefix. An overrides layer is put on top of the
+// backend if the configuration has an overrides section, which is itself a
+// backend configuration.
+func createBackend(prefix string, config *viper.Viper) (enum.Backend, error) {
+	config.SetDefault("backend", "memory")
+	config.SetDefault("sql.driver", "mysql")
+	config.SetDefault("memory.snapshot", "1m")
+	config.SetDefault("cache.ttl", "10s")
+
+	var backend enum.Backend
+	var err error
+	switch config.GetString("backend") {
+	case "sql":
+		backend, err = sqlbackend.NewSqlBackend(config.GetString("sql.driver"), config.GetString("sql.source"))
+	case "memory":
+		if path := config.GetString("memory.path"); path != "" {
+			backend, err = memory.NewPersistentMemoryBackend(path, config.GetDuration("memory.snapshot"))
+		} else {
+			backend, err = memory.NewMemoryBackend()
+		}
+	default:
+		err = fmt.Errorf("unknown backend %q", config.GetString("backend"))
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if size := config.GetInt("cache.size"); size > 0 {
+		cached := cache.NewCachingBackend(backend, size, config.GetDuration("cache.ttl"))
+		expvar.Publish(prefix+"cache", expvar.Func(func() interface{} { return cached.Stats() }))
+		backend = cached
+	}
+
+	// The overrides are not cached since they are changed without going
+	// through the cache.
+	if sub := config.Sub("overrides"); sub != nil {
+		overrides, err := createBackend(prefix+"overrides.", sub)
+		if err != nil {
+			backend.Close()
+			return nil, fmt.Errorf("overrides: %v", err)
+		}
+		backend = layered.NewLayeredBackend(overrides, backend)
+	}
+
+	return backend, nil
+}